@@ -18,6 +18,11 @@
 // weights, partition stickiness control, and multi-master support.
 package blance
 
+import (
+	"fmt"
+	"time"
+)
+
 // A PartitionMap represents all the partitions for some logical
 // resource, where the partitions are assigned to different nodes and
 // with different states.  For example, partition "A-thru-H" is
@@ -134,11 +139,14 @@ func PlanNextMap(
 }
 
 // PlanNextMapEx is the main entry point to the algorithm to assign
-// partitions to nodes.  The prevMap must define the partitions.
-// Partitions must be stable between PlanNextMapEx() runs.  That is,
-// splitting and merging or partitions are an orthogonal concern and
-// must be done separately than PlanNextMapEx() invocations.  The
-// nodeAll parameters is all nodes (union of existing nodes, nodes to
+// partitions to nodes.  The prevMap must define the partitions,
+// except for new partitions that are listed in the
+// PlanNextMapOptions.PartitionsToAdd.  Partitions must otherwise be
+// stable between PlanNextMapEx() runs.  That is, splitting and
+// merging or partitions are an orthogonal concern and must be done
+// separately than PlanNextMapEx() invocations, such as with
+// PlanSplitPartition() and PlanMergePartitions().  The nodeAll
+// parameters is all nodes (union of existing nodes, nodes to
 // be added, nodes to be removed, nodes that aren't changing).  The
 // nodesToRemove may be empty.  The nodesToAdd may be empty.  When
 // both nodesToRemove and nodesToAdd are empty, partitioning
@@ -151,8 +159,180 @@ func PlanNextMapEx(
 	nodesToAdd []string,
 	model PartitionModel,
 	options PlanNextMapOptions) (nextMap PartitionMap, warnings []string) {
-	return planNextMapEx(prevMap, nodesAll, nodesToRemove, nodesToAdd,
-		model, options)
+	nextMap, planWarnings, _ := planNextMapEx(prevMap,
+		nodesAll, nodesToRemove, nodesToAdd, model, options)
+	return nextMap, planWarningStrings(planWarnings)
+}
+
+// PlanNextMapStats is the same as PlanNextMapEx(), but also returns
+// PlanStats, such as whether the planner converged.
+func PlanNextMapStats(
+	prevMap PartitionMap,
+	nodesAll []string, // Union of nodesBefore, nodesToAdd, nodesToRemove.
+	nodesToRemove []string,
+	nodesToAdd []string,
+	model PartitionModel,
+	options PlanNextMapOptions) (
+	nextMap PartitionMap, warnings []string, stats PlanStats) {
+	nextMap, planWarnings, stats := planNextMapEx(prevMap,
+		nodesAll, nodesToRemove, nodesToAdd, model, options)
+	return nextMap, planWarningStrings(planWarnings), stats
+}
+
+// PlanStats reports on how the planner reached its result.  The
+// planner reruns its greedy algorithm on its own output until the map
+// stops changing (a fixed point), or until it reaches the
+// MaxIterations.
+//
+// The PromoteDemoteOnly mode, and the IncrementalConstraints mode
+// when it doesn't fall back to the full planning, don't run the
+// greedy algorithm or check for a fixed point, so they always report
+// an Iterations of 1 and a Converged of true.
+type PlanStats struct {
+	// Iterations is the number of runs of the greedy algorithm.
+	Iterations int
+
+	// Converged is true when the last iteration reached a fixed
+	// point, and is false when the planner instead stopped because
+	// it ran out of iterations.
+	Converged bool
+}
+
+// PlanNextMapV2 is the same as PlanNextMapEx(), but returns a
+// PlanResult, which has everything that an application might want to
+// log or act on about a plan.
+func PlanNextMapV2(
+	prevMap PartitionMap,
+	nodesAll []string, // Union of nodesBefore, nodesToAdd, nodesToRemove.
+	nodesToRemove []string,
+	nodesToAdd []string,
+	model PartitionModel,
+	options PlanNextMapOptions) *PlanResult {
+	startTime := time.Now()
+
+	nextMap, warnings, stats := planNextMapEx(prevMap,
+		nodesAll, nodesToRemove, nodesToAdd, model, options)
+
+	planDuration := time.Since(startTime)
+
+	moves := calcPlanMoves(prevMap, nextMap, model, options.FavorMinNodes)
+
+	return &PlanResult{
+		NextMap:       nextMap,
+		Warnings:      warnings,
+		PlanStats:     stats,
+		NodeLoads:     calcNodeLoads(prevMap, nextMap, nodesAll, options),
+		Moves:         moves,
+		PlanDuration:  planDuration,
+		TotalDuration: time.Since(startTime),
+	}
+}
+
+// A PlanResult is returned by PlanNextMapV2().
+type PlanResult struct {
+	NextMap  PartitionMap
+	Warnings []PlanWarning
+
+	PlanStats
+
+	// NodeLoads is keyed by node, for every node in the nodesAll.
+	NodeLoads map[string]*NodeLoad
+
+	// Moves is keyed by partitionName, and has the moves from
+	// CalcPartitionMoves() for every partition that's changed between
+	// the prevMap and the NextMap.  The moves are computed with the
+	// states ordered by priority and with the FavorMinNodes option.
+	Moves map[string][]NodeStateOp
+
+	// PlanDuration is the time spent planning the NextMap, and the
+	// TotalDuration also includes computing the Moves and NodeLoads.
+	PlanDuration  time.Duration
+	TotalDuration time.Duration
+}
+
+// A NodeLoad is the sum of the weights of the partitions assigned to
+// a node, across all states and per state, before (in the prevMap)
+// and after (in the NextMap) a plan.
+type NodeLoad struct {
+	Before float64
+	After  float64
+
+	BeforeByState map[string]float64 // Keyed by stateName.
+	AfterByState  map[string]float64 // Keyed by stateName.
+}
+
+// A PlanWarningCode categorizes a PlanWarning.
+type PlanWarningCode string
+
+// WarningConstraintsNotMet means there were not enough nodes to
+// assign a partition to as many nodes as the constraints of a state.
+const WarningConstraintsNotMet = PlanWarningCode("constraints-not-met")
+
+// WarningInsufficientCapacity is like WarningConstraintsNotMet, but
+// is due to nodes having reached their NodeCapacities or
+// NodeStateCapacities, or the MaxPartitions of their NodeDrains.
+const WarningInsufficientCapacity = PlanWarningCode("insufficient-capacity")
+
+// WarningPinNotMet means a partition was assigned to nodes in the
+// StateName that it's not pinned to, per the PartitionPins.
+const WarningPinNotMet = PlanWarningCode("pin-not-met")
+
+// WarningAntiAffinityNotMet means a partition was assigned in the
+// StateName to a node that has another partition from the same
+// anti-affinity group, per the AntiAffinityGroups.
+const WarningAntiAffinityNotMet = PlanWarningCode("anti-affinity-not-met")
+
+// WarningStateNotAllowed is like WarningConstraintsNotMet, but is due
+// to nodes that may not hold the StateName, per the NodeAllowedStates
+// or NodeDrains.
+const WarningStateNotAllowed = PlanWarningCode("state-not-allowed")
+
+// WarningIncrementalImbalanced means the IncrementalConstraints option
+// led to a map where the StateName was too imbalanced, so the
+// planner fell back to full planning.
+const WarningIncrementalImbalanced = PlanWarningCode("incremental-imbalanced")
+
+// A PlanWarning is a problem found by the planner, where the planner
+// still returned its best effort next map.
+type PlanWarning struct {
+	Code        PlanWarningCode
+	StateName   string
+	Partition   string
+	Constraints int
+}
+
+// String returns the warning in the same format as the warnings that
+// are returned by PlanNextMapEx().
+func (w PlanWarning) String() string {
+	switch w.Code {
+	case WarningConstraintsNotMet:
+		return fmt.Sprintf("could not meet constraints: %d,"+
+			" stateName: %s, partitionName: %s",
+			w.Constraints, w.StateName, w.Partition)
+	case WarningInsufficientCapacity:
+		return fmt.Sprintf("could not meet constraints: %d,"+
+			" stateName: %s, partitionName: %s,"+
+			" due to insufficient node capacity",
+			w.Constraints, w.StateName, w.Partition)
+	case WarningStateNotAllowed:
+		return fmt.Sprintf("could not meet constraints: %d,"+
+			" stateName: %s, partitionName: %s,"+
+			" due to nodes that are not allowed the state",
+			w.Constraints, w.StateName, w.Partition)
+	case WarningPinNotMet:
+		return fmt.Sprintf("could not meet pins,"+
+			" stateName: %s, partitionName: %s",
+			w.StateName, w.Partition)
+	case WarningAntiAffinityNotMet:
+		return fmt.Sprintf("could not meet anti-affinity,"+
+			" stateName: %s, partitionName: %s",
+			w.StateName, w.Partition)
+	case WarningIncrementalImbalanced:
+		return fmt.Sprintf("incremental constraints were too imbalanced,"+
+			" stateName: %s, so used full planning", w.StateName)
+	}
+	return fmt.Sprintf("%s, stateName: %s, partitionName: %s",
+		w.Code, w.StateName, w.Partition)
 }
 
 // PlanNextMapOptions represents optional parameters to the
@@ -165,10 +345,15 @@ func PlanNextMapEx(
 // Hawaii); default partition weight is 1.  The StateStickiness is
 // optional and is keyed by stateName; it allows the caller to prefer
 // not moving data at the tradeoff of potentially more imbalance;
-// default state stickiness is 1.5.  The NodeWeights is optional and
-// is keyed by node name; it allows the caller to specify that some
-// nodes can hold more partitions than other nodes; default node
-// weight is 1.  The NodeHierarchy defines optional parent
+// default state stickiness is 1.5.  Stickiness is independent of
+// partition weight, so resizing a partition doesn't change its
+// stickiness, unless a MoveCostFactor is used (note: in earlier
+// versions, a partition's weight was used as its stickiness whenever
+// the partition was found in PartitionWeights, and StateStickiness
+// was ignored when PartitionWeights was nil).  The NodeWeights is
+// optional and is keyed by node name; it allows the caller to specify
+// that some nodes can hold more partitions than other nodes; default
+// node weight is 1.  The NodeHierarchy defines optional parent
 // relationships per node; it is keyed by node and a value is the
 // node's parent.  The HierarchyRules allows the caller to optionally
 // define slave placement policy (e.g., same/different rack;
@@ -180,4 +365,376 @@ type PlanNextMapOptions struct {
 	NodeWeights           map[string]int    // Keyed by node.
 	NodeHierarchy         map[string]string // Keyed by node; value is node's parent.
 	HierarchyRules        HierarchyRules
+
+	// NodeCapacities is optional and is keyed by node.  It is a hard
+	// limit on the sum of the partition weights, across all states,
+	// that the planner will assign to a node.  Unlike NodeWeights,
+	// which only influences balance, the planner never exceeds a
+	// node's capacity, and will instead warn when the cluster does
+	// not have enough capacity to meet the constraints.
+	NodeCapacities map[string]int
+
+	// NodeStateCapacities is optional and is keyed by node and then by
+	// stateName.  It is a hard limit on the sum of the partition
+	// weights in a given state that the planner will assign to a
+	// node.  For example, {"a": {"master": 10}} means node "a" will
+	// be assigned at most 10 weighted master partitions.
+	NodeStateCapacities map[string]map[string]int
+
+	// PartitionResources is optional and is keyed by partitionName and
+	// then by resource name, such as "disk", "memory" or "qps".  When
+	// provided, the planner balances the usage of every resource
+	// dimension independently, by minimizing the highest utilization
+	// across the dimensions, instead of balancing by the scalar
+	// PartitionWeights.  A partition that's missing a resource is
+	// treated as using none of that resource.
+	PartitionResources map[string]map[string]int
+
+	// NodeResources is optional and is keyed by node and then by
+	// resource name.  It allows the caller to specify that some nodes
+	// have more of a resource than other nodes (e.g., bigger disks).
+	// A node that's missing a resource is treated as having the
+	// average amount of that resource.  NodeResources is only used
+	// along with PartitionResources.
+	NodeResources map[string]map[string]int
+
+	// PartitionStateWeights is optional and is keyed by partitionName
+	// and then by stateName.  It allows the caller to specify that a
+	// partition is heavier in some states than in others (e.g., a
+	// master costs more CPU than a replica of the same partition).
+	// When a partition and state is found in PartitionStateWeights, it
+	// takes precedence over the PartitionWeights.
+	PartitionStateWeights map[string]map[string]int
+
+	// PartitionStickiness is optional and is keyed by partitionName.
+	// It overrides the StateStickiness for individual partitions,
+	// such as for partitions that are especially expensive to move.
+	PartitionStickiness map[string]int
+
+	// MoveCostFactor is optional and adds a move cost to the
+	// stickiness that's proportional to a partition's weight, so that
+	// heavier partitions are less likely to be moved.  That is, the
+	// effective stickiness of a partition in a state is its
+	// StateStickiness (or PartitionStickiness) plus the MoveCostFactor
+	// times the partition's weight in that state.  Default is 0.
+	MoveCostFactor float64
+
+	// PartitionWeightsFloat, NodeWeightsFloat and StateStickinessFloat
+	// are optional, float-valued alternatives to the PartitionWeights,
+	// NodeWeights and StateStickiness, allowing for fine-grained
+	// values such as a node weight of 1.5 or a state stickiness of
+	// 0.75.  When a key is found in both the int and float maps, the
+	// float value takes precedence.
+	PartitionWeightsFloat map[string]float64 // Keyed by partitionName.
+	NodeWeightsFloat      map[string]float64 // Keyed by node.
+	StateStickinessFloat  map[string]float64 // Keyed by stateName.
+
+	// NodeScorer is optional and allows the application to replace or
+	// wrap the heuristic that ranks the candidate nodes for a
+	// partition, such as to also consider node health, CPU load or
+	// cost.  When nil, DefaultScoreNode is used.
+	NodeScorer NodeScorer
+
+	// PartitionOrderer is optional and allows the application to
+	// control the order in which partitions are assigned to nodes,
+	// such as to place business-critical partitions first, as earlier
+	// partitions have more choices of nodes.  When nil,
+	// DefaultOrderPartition is used.
+	PartitionOrderer PartitionOrderer
+
+	// LocalSearch is optional and, when non-nil, enables a refinement
+	// pass after the greedy planner, which searches for a better map
+	// by trying to move and swap partition assignments.  It's meant
+	// for clusters where balance matters more than planning latency.
+	LocalSearch *LocalSearchOptions
+
+	// MaxIterations is optional and controls how many iterations the
+	// planner will attempt to try to converge to a stabilized plan.
+	// When 0, the global MaxIterationsPerPlan is used.
+	MaxIterations int
+
+	// FavorMinNodes is only used by PlanNextMapV2(), and is passed
+	// along to CalcPartitionMoves() when computing the moves.
+	FavorMinNodes bool
+
+	// PartitionsToAdd are the names of partitions that are being
+	// created, which the planner assigns to nodes from scratch.  They
+	// don't need to be in the prevMap.
+	PartitionsToAdd []string
+
+	// PartitionsToRemove are the names of partitions that are being
+	// deleted, which are in the prevMap but won't be in the next map.
+	// The OrchestratorOptions have matching fields, so the prevMap
+	// and next map can be used to orchestrate the deletions.
+	PartitionsToRemove []string
+
+	// IncrementalConstraints is optional and, when true, the planner
+	// only adds or trims the nodes of partitions to meet the
+	// constraints, such as after a change to the
+	// ModelStateConstraints from 1 replica to 2 replicas, and leaves
+	// the other assignments alone.  If the resulting map is too
+	// imbalanced, per the IncrementalMaxImbalance, the planner
+	// instead falls back to full planning, with a warning.  The
+	// nodes to add or trim are chosen with the same scoring as the
+	// full planning, so the NodeScorer, PartitionResources,
+	// StateStickiness and PartitionOrderer options apply, and the
+	// PartitionPins and AntiAffinityGroups are favored with the same
+	// warnings, but the LocalSearch is only used when falling back to
+	// full planning.
+	IncrementalConstraints bool
+
+	// IncrementalMaxImbalance is the largest acceptable difference
+	// between the most and least loaded nodes in any state, relative
+	// to the average load, for the IncrementalConstraints option.
+	// Default is 1.  A negative value means the planner never falls
+	// back to full planning.
+	IncrementalMaxImbalance float64
+
+	// PartitionStateConstraints is optional and is keyed by
+	// partitionName and then by stateName.  It overrides the
+	// constraints from the model and ModelStateConstraints for
+	// individual partitions, such as to have 3 replicas of a system
+	// partition while the other partitions have 1 replica.
+	PartitionStateConstraints map[string]map[string]int
+
+	// PartitionPins is optional and is keyed by partitionName and then
+	// by stateName, where the value is the nodes that the partition
+	// is pinned to in that state.  The planner only assigns the
+	// partition in that state to the pinned nodes, unless there
+	// aren't enough usable pinned nodes to meet the constraints, in
+	// which case the planner uses other nodes and warns with a
+	// WarningPinNotMet.
+	PartitionPins map[string]map[string][]string
+
+	// AntiAffinityGroups is optional and is keyed by a group name,
+	// where the value is the names of partitions that should not be
+	// assigned to the same nodes, in any state, such as to spread the
+	// partitions of a tenant across different nodes.  When that's
+	// not possible, the planner warns with a
+	// WarningAntiAffinityNotMet.  The PartitionPins take precedence
+	// over the AntiAffinityGroups.
+	AntiAffinityGroups map[string][]string
+
+	// AffinityGroups is optional and is keyed by a group name, where
+	// the value is the names of partitions that must be co-located,
+	// such as partitions that are joined together at query time.
+	// Every partition in a group is assigned the same NodesByState as
+	// the group's first partition (its leader), where the group is
+	// balanced as one partition with the combined weight of the
+	// group.  The rules for the leader, like its PartitionPins, apply
+	// to the whole group.  A partition should be in at most one
+	// affinity group.  The LocalSearch does not move the partitions
+	// of affinity groups.
+	AffinityGroups map[string][]string
+
+	// NodeBaselineLoads is optional and is keyed by node.  It is the
+	// load that a node already has from work outside of the partition
+	// map, such as unrelated workloads, in the same units as the
+	// PartitionWeights, across all states.  The planner counts it as
+	// part of the node's total load, so that busy nodes are assigned
+	// fewer partitions, and it also counts against the node's
+	// NodeCapacities.  As the total node load only breaks ties
+	// between nodes with the same load in a state, the
+	// NodeStateBaselineLoads have a stronger effect.
+	NodeBaselineLoads map[string]float64
+
+	// NodeStateBaselineLoads is optional and is keyed by node and then
+	// by stateName.  It is like the NodeBaselineLoads, but is counted
+	// as part of the node's load in a given state, so it's balanced
+	// along with the partitions in that state, and also counts against
+	// the node's NodeStateCapacities.  For example, {"a": {"master":
+	// 10}} means node "a" is treated as if it already had 10 weighted
+	// master partitions.
+	NodeStateBaselineLoads map[string]map[string]float64
+
+	// NodeDrains is optional and is keyed by node.  It lets an
+	// operator take a node out of service in stages, by lowering the
+	// node's share of the partitions over successive plans, while the
+	// node remains in nodesAll, unlike with nodesToRemove, which
+	// evicts all of a node's partitions at once.
+	NodeDrains map[string]*NodeDrain
+
+	// NodeAllowedStates is optional and is keyed by node, where the
+	// value is the names of the only states that the node may be
+	// assigned, such as a read-only node, or a node with slow disks,
+	// that may hold "slave" but never "master" partitions.  Nodes that
+	// are missing from the NodeAllowedStates may hold any state.  When
+	// the constraints can't be met due to the allowed states, the
+	// planner warns with a WarningStateNotAllowed.
+	NodeAllowedStates map[string][]string
+
+	// NodeWarmUps is optional and is keyed by node, where the value is
+	// the fraction of the node's fair share of the partitions that the
+	// node may hold, so that new hardware, such as a node in the
+	// nodesToAdd, can be ramped up gradually.  For example, a caller
+	// may warm up a new node over successive plans with 0.25, then 0.5,
+	// then 1.  The fair share is the sum of the weighted partitions of
+	// every state, per the constraints, divided among the nodes per
+	// their NodeWeights, and the resulting limit acts like a lowered
+	// NodeCapacities.  A fraction >= 1 means no limit.
+	NodeWarmUps map[string]float64
+
+	// PromoteDemoteOnly, when true, has the planner only rebalance the
+	// top priority state (e.g., "master"), such as after failovers
+	// have piled up the masters on the surviving nodes, by swapping
+	// the roles of the nodes that already hold copies of a partition.
+	// So, the next map needs only promote and demote operations and no
+	// data copies.  The top priority state is moved off of the
+	// nodesToRemove, and the NodeWeights, NodeAllowedStates,
+	// NodeDrains, NodeCapacities and NodeStateCapacities are respected,
+	// along with the partition weights and baseline loads that count
+	// against those capacities, but the
+	// other options are ignored, and the nodesToAdd are not assigned
+	// anything, as they have no copies.  A partition whose top
+	// priority state is left on a node to remove, or on a node with a
+	// weight <= 0, for lack of a replica to promote, or that has no
+	// node at all, such as a partition from the PartitionsToAdd, has
+	// a WarningConstraintsNotMet.
+	PromoteDemoteOnly bool
+}
+
+// A NodeDrain describes how a node is drained, per the NodeDrains
+// option of PlanNextMapOptions.  Both fields may be used together.
+type NodeDrain struct {
+	// States are the names of the states that the node should no
+	// longer be assigned, such as "master", so that the node keeps
+	// its replicas but its masters are moved elsewhere.  Listing all
+	// the states of the model drains the node completely.
+	States []string
+
+	// MaxPartitions, when > 0, is a hard limit on the sum of the
+	// partition weights, across all states, that the node keeps, like
+	// a lowered NodeCapacities.
+	MaxPartitions int
+}
+
+// LocalSearchOptions controls the optional refinement pass of the
+// planner, which uses local search (or simulated annealing, when the
+// Temperature is > 0) to minimize a cost that's the sum of the
+// imbalance of the nodes, the cost of moving partitions compared to
+// the prevMap, and the violations of the capacity, allowed state,
+// hierarchy, pin and anti-affinity rules.  The refinement only
+// relocates the greedy planner's assignments, so it never changes how
+// many nodes a partition has in a state.
+type LocalSearchOptions struct {
+	// MaxIterations is the number of candidate changes to try.  When
+	// both MaxIterations and MaxDuration are 0, the default is 100
+	// iterations per partition.
+	MaxIterations int
+
+	// MaxDuration optionally limits the wall-clock time of the
+	// refinement pass.
+	MaxDuration time.Duration
+
+	// Seed is for the random number generator, so that a refinement
+	// is repeatable when it's limited only by MaxIterations.
+	Seed int64
+
+	// Temperature is the initial temperature for simulated annealing,
+	// which cools linearly to 0 over the iterations.  With the
+	// default of 0, only changes that lower the cost are accepted.
+	Temperature float64
+
+	// ImbalanceCost, MoveCost and ViolationCost are the multipliers
+	// for each part of the cost, where the defaults are 1, 1 and 1000.
+	// A move of a partition is charged its stickiness times the
+	// MoveCost, and the imbalance is the sum of the squares of the
+	// node loads, divided by the node weights.
+	ImbalanceCost float64
+	MoveCost      float64
+	ViolationCost float64
+}
+
+// A NodeScorer computes a score for a candidate node during planning,
+// where the planner favors nodes with lower scores when assigning a
+// partition to a state.  Ties are broken by the node's position in
+// the nodesAll parameter.
+type NodeScorer interface {
+	ScoreNode(s *NodeScore) float64
+}
+
+// NodeScorerFunc is an adapter to allow the use of an ordinary func
+// as a NodeScorer.
+type NodeScorerFunc func(s *NodeScore) float64
+
+// ScoreNode implements the NodeScorer interface by calling f(s).
+func (f NodeScorerFunc) ScoreNode(s *NodeScore) float64 {
+	return f(s)
+}
+
+// A NodeScore holds the inputs to a NodeScorer for a single candidate
+// node, for a given partition and state.
+type NodeScore struct {
+	Node      string
+	StateName string
+	Partition *Partition
+
+	// NumPartitions is the total number of partitions being planned.
+	NumPartitions int
+
+	// TopPriorityNode is the node where the partition is assigned to
+	// the top priority state (e.g., "master"), or "" if none.
+	TopPriorityNode string
+
+	// StateLoad is the sum of the weights of the partitions that are
+	// assigned to the node in the StateName, or, when the
+	// PartitionResources option is used, the node's highest resource
+	// utilization.
+	StateLoad float64
+
+	// NodeLoad is the sum of the weights of all partitions that are
+	// assigned to the node, across all states.
+	NodeLoad float64
+
+	// LowerPriorityCount is the number of partitions assigned so far
+	// to the node in the StateName whose top priority state is on the
+	// TopPriorityNode, which helps to spread out slaves.
+	LowerPriorityCount int
+
+	// NodeWeight is the node's weight, where the default is 1.
+	NodeWeight float64
+
+	// Current is true when the partition is already assigned to the
+	// node in the StateName, and Stickiness is how much the partition
+	// prefers to stay put.
+	Current    bool
+	Stickiness float64
+}
+
+// A PartitionOrderer computes a sort key for a partition during
+// planning, where the planner assigns nodes to partitions in the
+// ascending order of their sort keys, comparing the sort keys
+// element by element.  Ties are broken by partition name.
+type PartitionOrderer interface {
+	OrderPartition(p *PartitionOrder) []string
+}
+
+// PartitionOrdererFunc is an adapter to allow the use of an ordinary
+// func as a PartitionOrderer.
+type PartitionOrdererFunc func(p *PartitionOrder) []string
+
+// OrderPartition implements the PartitionOrderer interface by calling
+// f(p).
+func (f PartitionOrdererFunc) OrderPartition(p *PartitionOrder) []string {
+	return f(p)
+}
+
+// A PartitionOrder holds the inputs to a PartitionOrderer for a
+// single partition, for the state that's being assigned.
+type PartitionOrder struct {
+	// Partition has the partition's in-progress assignments, which
+	// should be treated as immutable.
+	Partition *Partition
+
+	// PrevPartition is the partition from the prevMap, or nil.
+	PrevPartition *Partition
+
+	StateName string
+
+	// Weight is the partition's weight in the StateName, which is the
+	// combined weight of the group for an affinity group's leader.
+	Weight float64
+
+	NodesToRemove []string
+	NodesToAdd    []string
 }
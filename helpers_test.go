@@ -0,0 +1,40 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Returns a map of 8 partitions that's fully planned on the nodes,
+// with the given number of slaves, as the prevMap for tests that
+// change an already balanced map.
+func testPlanPrevMap(t *testing.T, nodes []string,
+	model PartitionModel, numSlaves int) PartitionMap {
+	prevMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	prevMap, warnings := PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, model, PlanNextMapOptions{
+			ModelStateConstraints: map[string]int{"slave": numSlaves},
+		})
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	return prevMap
+}
@@ -0,0 +1,402 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"sort"
+)
+
+// Plans the next map for the IncrementalConstraints option, by only
+// adding or trimming the nodes of each partition's states to meet
+// the constraints, leaving the other assignments alone.  When the
+// partitionNames is non-nil, only those partitions are planned, while
+// the other partitions are still counted as load.  Also returns the
+// name of a state that's too imbalanced per the
+// IncrementalMaxImbalance, or "" if the next map is balanced enough.
+func planIncremental(
+	prevMap PartitionMap,
+	nodesAll []string, // Union of nodesBefore, nodesToAdd, nodesToRemove.
+	nodesToRemove []string,
+	model PartitionModel,
+	opts PlanNextMapOptions,
+	partitionNames map[string]bool,
+) (PartitionMap, []PlanWarning, string) {
+	warnings := []PlanWarning{}
+
+	nodePositions := map[string]int{}
+	for i, node := range nodesAll {
+		nodePositions[node] = i
+	}
+
+	nodesNext := StringsRemoveStrings(nodesAll, nodesToRemove)
+
+	hierarchyChildren := mapParentsToMapChildren(opts.NodeHierarchy)
+
+	nodeWeights := mergeWeights(opts.NodeWeights, opts.NodeWeightsFloat)
+
+	stateNames := sortStateNames(model)
+
+	nextPartitions := prevMap.toArrayCopy()
+	for _, partition := range nextPartitions {
+		partition.NodesByState =
+			removeNodesFromNodesByState(partition.NodesByState,
+				nodesToRemove, nil)
+	}
+
+	nextMap := PartitionMap{}
+	for _, partition := range nextPartitions {
+		nextMap[partition.Name] = partition
+	}
+
+	// Key is stateName, value is {node: count}.
+	stateNodeCounts := countStateNodes(nextMap, opts)
+
+	addBaselineStateNodeCounts(stateNodeCounts, opts)
+
+	// Keyed by node, value is sum of partitions on that node.
+	nodePartitionCounts := countNodePartitions(stateNodeCounts, opts)
+
+	// Key is stateName, then resource name, value is {node: amount}.
+	var stateResourceNodeCounts map[string]map[string]map[string]int
+
+	var resourceUnits map[string]float64
+	var nodeResourceScales map[string]map[string]float64
+
+	if opts.PartitionResources != nil {
+		stateResourceNodeCounts =
+			countStateNodeResources(nextMap, opts.PartitionResources)
+
+		resourceUnits, nodeResourceScales =
+			calcResourceScales(prevMap, nodesNext,
+				opts.PartitionResources, opts.NodeResources)
+	}
+
+	// Keyed by the partitionName of an affinity group's leader, value
+	// is the group's partitions, with the leader first.
+	affinityGroups := mapAffinityGroups(opts.AffinityGroups, nextMap)
+
+	affinityFollowers := map[string]bool{}
+	for _, members := range affinityGroups {
+		for _, member := range members[1:] {
+			affinityFollowers[member.Name] = true
+		}
+	}
+
+	// Keyed by partitionName, value is the other partitions that
+	// share an anti-affinity group with the partition.
+	antiAffinityPartitions := mapAntiAffinityPartitions(opts.AntiAffinityGroups)
+
+	// Adds (sign of 1) or removes (sign of -1) the partition in the
+	// stateName on the node, keeping the counts updated.
+	adjustCounts := func(partitionName, stateName, node string, sign int) {
+		amt := float64(sign) *
+			getPartitionWeight(partitionName, stateName, opts)
+		adjustStateNodeCounts(stateNodeCounts, stateName, []string{node}, amt)
+		nodePartitionCounts[node] = nodePartitionCounts[node] + amt
+		if stateResourceNodeCounts != nil {
+			adjustStateNodeResources(stateResourceNodeCounts,
+				stateName, []string{node},
+				opts.PartitionResources[partitionName], sign)
+		}
+	}
+
+	// Returns the node where the partition is assigned to the top
+	// priority state, or "" if none.
+	topPriorityNode := func(partition *Partition) string {
+		if len(stateNames) > 0 {
+			topNodes := partition.NodesByState[stateNames[0]]
+			if len(topNodes) > 0 {
+				return topNodes[0]
+			}
+		}
+		return ""
+	}
+
+	// Sorts the nodes from the best to the worst fit for the
+	// partition in the stateName, with the same nodeSorter as the
+	// full planning.
+	sortNodes := func(partition *Partition, stateName string,
+		nodes []string, nodeToNodeCounts map[string]map[string]int) {
+		sort.Sort(&nodeSorter{
+			stateName:           stateName,
+			partition:           partition,
+			numPartitions:       len(prevMap),
+			topPriorityNode:     topPriorityNode(partition),
+			stateNodeCounts:     stateNodeCounts,
+			nodeToNodeCounts:    nodeToNodeCounts,
+			nodePartitionCounts: nodePartitionCounts,
+			nodePositions:       nodePositions,
+			nodeWeights:         nodeWeights,
+			stickiness:          getStickiness(partition.Name, stateName, opts),
+			nodeScorer:          opts.NodeScorer,
+			a:                   nodes,
+
+			nodeResourceCounts: stateResourceNodeCounts[stateName],
+			resourceUnits:      resourceUnits,
+			nodeResourceScales: nodeResourceScales,
+		})
+	}
+
+	for _, stateName := range stateNames {
+		stateConstraints := getStateConstraints(stateName, model, opts)
+		if stateConstraints <= 0 &&
+			!hasPartitionConstraints(stateName, opts) {
+			continue
+		}
+
+		p := &partitionSorter{
+			stateName:      stateName,
+			prevMap:        prevMap,
+			nodesToRemove:  nodesToRemove,
+			opts:           opts,
+			affinityGroups: affinityGroups,
+			a:              append([]*Partition(nil), nextPartitions...),
+		}
+		sort.Sort(p)
+
+		// Key is higherPriorityNode, value is {lowerPriorityNode: count}.
+		nodeToNodeCounts := make(map[string]map[string]int)
+
+		for _, partition := range p.a {
+			if affinityFollowers[partition.Name] ||
+				(partitionNames != nil && !partitionNames[partition.Name]) {
+				continue
+			}
+
+			constraints, exists := getPartitionConstraints(partition.Name,
+				stateName, stateConstraints, opts)
+			if constraints <= 0 && !exists {
+				continue
+			}
+
+			members := affinityGroups[partition.Name]
+			if members == nil {
+				members = []*Partition{partition}
+			}
+
+			placement := newPlacementRules(partition.Name, stateName,
+				nextMap, antiAffinityPartitions, opts)
+
+			nodes := append([]string(nil),
+				partition.NodesByState[stateName]...)
+
+			// Trim the nodes that may no longer hold the partition in
+			// this state, such as nodes that are being drained, or
+			// that are over their capacities.
+			if opts.NodeDrains != nil || opts.NodeAllowedStates != nil ||
+				opts.NodeCapacities != nil || opts.NodeStateCapacities != nil {
+				for i := 0; i < len(nodes); {
+					if nodeAllowsState(nodes[i], stateName, opts) &&
+						nodeHasCapacity(nodes[i], members, stateName,
+							stateNodeCounts[stateName],
+							nodePartitionCounts, opts) {
+						i++
+						continue
+					}
+					adjustCounts(partition.Name, stateName, nodes[i], -1)
+					nodes = append(nodes[0:i], nodes[i+1:]...)
+				}
+			}
+
+			// Trim the nodes that are the worst fit, starting with the
+			// nodes that don't meet the placement rules.
+			for len(nodes) > constraints {
+				sortedNodes := append([]string(nil), nodes...)
+				sortNodes(partition, stateName, sortedNodes,
+					nodeToNodeCounts)
+				sortedNodes = placement.order(sortedNodes)
+				worst := sortedNodes[len(sortedNodes)-1]
+				adjustCounts(partition.Name, stateName, worst, -1)
+				nodes = StringsRemoveStrings(nodes, []string{worst})
+			}
+
+			// Add the nodes that are the least loaded.
+			for len(nodes) < constraints {
+				partition.NodesByState[stateName] = nodes
+
+				candidateNodes := StringsRemoveStrings(nodesNext,
+					flattenNodesByState(partition.NodesByState))
+
+				numCandidateNodes := len(candidateNodes)
+
+				if opts.NodeDrains != nil || opts.NodeAllowedStates != nil {
+					rv := make([]string, 0, len(candidateNodes))
+					for _, node := range candidateNodes {
+						if nodeAllowsState(node, stateName, opts) {
+							rv = append(rv, node)
+						}
+					}
+					candidateNodes = rv
+				}
+
+				notAllowed := len(candidateNodes) < numCandidateNodes
+
+				numCandidateNodes = len(candidateNodes)
+
+				if opts.NodeCapacities != nil ||
+					opts.NodeStateCapacities != nil ||
+					opts.NodeDrains != nil {
+					rv := make([]string, 0, len(candidateNodes))
+					for _, node := range candidateNodes {
+						if nodeHasCapacity(node, members, stateName,
+							stateNodeCounts[stateName],
+							nodePartitionCounts, opts) {
+							rv = append(rv, node)
+						}
+					}
+					candidateNodes = rv
+				}
+
+				overCapacity := len(candidateNodes) < numCandidateNodes
+
+				rules := opts.HierarchyRules[stateName]
+				if len(nodes) < len(rules) {
+					h := ""
+					topNodes := partition.NodesByState[stateNames[0]]
+					if len(topNodes) > 0 {
+						h = topNodes[0]
+					} else if len(nodes) > 0 {
+						h = nodes[0]
+					}
+					if h != "" {
+						rule := rules[len(nodes)]
+						hierarchyCandidates :=
+							StringsIntersectStrings(candidateNodes,
+								includeExcludeNodes(h,
+									rule.IncludeLevel, rule.ExcludeLevel,
+									opts.NodeHierarchy, hierarchyChildren))
+						if len(hierarchyCandidates) > 0 {
+							candidateNodes = hierarchyCandidates
+						}
+					}
+				}
+
+				if len(candidateNodes) <= 0 {
+					code := WarningConstraintsNotMet
+					if overCapacity {
+						code = WarningInsufficientCapacity
+					} else if notAllowed {
+						code = WarningStateNotAllowed
+					}
+					warnings = append(warnings, PlanWarning{
+						Code:        code,
+						StateName:   stateName,
+						Partition:   partition.Name,
+						Constraints: constraints,
+					})
+					break
+				}
+
+				// Add the node that is the best fit, favoring the nodes
+				// that meet the placement rules.
+				sortNodes(partition, stateName, candidateNodes,
+					nodeToNodeCounts)
+				candidateNodes = placement.order(candidateNodes)
+				best := candidateNodes[0]
+				adjustCounts(partition.Name, stateName, best, 1)
+				nodes = append(nodes, best)
+			}
+
+			partition.NodesByState[stateName] = nodes
+
+			warnings = append(warnings, placement.warnings(partition.Name,
+				stateName, constraints, nodes)...)
+
+			// Keep nodeToNodeCounts updated.
+			m, exists := nodeToNodeCounts[topPriorityNode(partition)]
+			if !exists {
+				m = make(map[string]int)
+				nodeToNodeCounts[topPriorityNode(partition)] = m
+			}
+			for _, node := range nodes {
+				m[node] = m[node] + 1
+			}
+
+			// The affinity group's followers copy the leader.
+			for _, member := range members[1:] {
+				memberNodesByState :=
+					removeNodesFromNodesByState(member.NodesByState,
+						member.NodesByState[stateName], nil)
+				memberNodesByState =
+					removeNodesFromNodesByState(memberNodesByState,
+						nodes, nil)
+				for sName, sNodes := range member.NodesByState {
+					for _, node := range StringsRemoveStrings(sNodes,
+						memberNodesByState[sName]) {
+						adjustCounts(member.Name, sName, node, -1)
+					}
+				}
+
+				memberNodesByState[stateName] = append([]string{}, nodes...)
+				member.NodesByState = memberNodesByState
+
+				for _, node := range nodes {
+					adjustCounts(member.Name, stateName, node, 1)
+				}
+			}
+		}
+	}
+
+	maxImbalance := opts.IncrementalMaxImbalance
+	if maxImbalance == 0 {
+		maxImbalance = 1
+	}
+
+	if maxImbalance > 0 {
+		for _, stateName := range stateNames {
+			if getStateConstraints(stateName, model, opts) <= 0 &&
+				!hasPartitionConstraints(stateName, opts) {
+				continue
+			}
+			if calcImbalance(stateNodeCounts[stateName],
+				nodesNext, nodeWeights) > maxImbalance {
+				return nextMap, warnings, stateName
+			}
+		}
+	}
+
+	return nextMap, warnings, ""
+}
+
+// Returns the difference between the most and least loaded nodes,
+// relative to the average node load, where the node loads are
+// divided by the node weights, and nodes with weights <= 0 are
+// ignored.
+func calcImbalance(nodeCounts map[string]float64, // Keyed by node.
+	nodes []string, nodeWeights map[string]float64) float64 {
+	var min, max, sum float64
+	var n int
+
+	for _, node := range nodes {
+		load := nodeCounts[node]
+		if w, exists := nodeWeights[node]; exists {
+			if w <= 0 {
+				continue
+			}
+			load = load / w
+		}
+		if n == 0 || load < min {
+			min = load
+		}
+		if n == 0 || load > max {
+			max = load
+		}
+		sum = sum + load
+		n++
+	}
+
+	if n <= 0 || sum <= 0 {
+		return 0
+	}
+
+	return (max - min) / (sum / float64(n))
+}
@@ -0,0 +1,351 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanNextMapIncrementalConstraints(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+
+	// Raise the slaves from 1 to 2.
+	prevMap := testPlanPrevMap(t, nodes, model, 1)
+
+	r, warnings := PlanNextMapEx(prevMap,
+		nodes, []string{}, []string{}, model, PlanNextMapOptions{
+			ModelStateConstraints:  map[string]int{"slave": 2},
+			IncrementalConstraints: true,
+		})
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	for partitionName, partition := range r {
+		prevPartition := prevMap[partitionName]
+		if !reflect.DeepEqual(partition.NodesByState["master"],
+			prevPartition.NodesByState["master"]) ||
+			len(partition.NodesByState["slave"]) != 2 ||
+			partition.NodesByState["slave"][0] !=
+				prevPartition.NodesByState["slave"][0] {
+			t.Errorf("partition: %s, expected only an added slave,"+
+				" prev: %v, got: %v", partitionName,
+				prevPartition.NodesByState, partition.NodesByState)
+		}
+	}
+	exp := map[string]map[string]float64{
+		"master": {"a": 2, "b": 2, "c": 2, "d": 2},
+		"slave":  {"a": 4, "b": 4, "c": 4, "d": 4},
+	}
+	got := countStateNodes(r, PlanNextMapOptions{})
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("raise, exp: %v, got: %v", exp, got)
+	}
+
+	// Lower the slaves from 2 to 1.
+	prevMap = testPlanPrevMap(t, nodes, model, 2)
+
+	r, warnings = PlanNextMapEx(prevMap,
+		nodes, []string{}, []string{}, model, PlanNextMapOptions{
+			IncrementalConstraints: true,
+		})
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	for partitionName, partition := range r {
+		prevPartition := prevMap[partitionName]
+		if !reflect.DeepEqual(partition.NodesByState["master"],
+			prevPartition.NodesByState["master"]) ||
+			len(partition.NodesByState["slave"]) != 1 ||
+			len(StringsIntersectStrings(partition.NodesByState["slave"],
+				prevPartition.NodesByState["slave"])) != 1 {
+			t.Errorf("partition: %s, expected only a trimmed slave,"+
+				" prev: %v, got: %v", partitionName,
+				prevPartition.NodesByState, partition.NodesByState)
+		}
+	}
+	exp = map[string]map[string]float64{
+		"master": {"a": 2, "b": 2, "c": 2, "d": 2},
+		"slave":  {"a": 2, "b": 2, "c": 2, "d": 2},
+	}
+	got = countStateNodes(r, PlanNextMapOptions{})
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("lower, exp: %v, got: %v", exp, got)
+	}
+}
+
+func TestPlanNextMapIncrementalConstraintsWarnings(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+
+	// Not enough nodes for 2 slaves.
+	prevMap := testPlanPrevMap(t, []string{"a", "b"}, model, 1)
+
+	r := PlanNextMapV2(prevMap,
+		[]string{"a", "b"}, []string{}, []string{},
+		model, PlanNextMapOptions{
+			ModelStateConstraints:  map[string]int{"slave": 2},
+			IncrementalConstraints: true,
+		})
+	if len(r.Warnings) != len(prevMap) {
+		t.Errorf("expected warnings, got: %v", r.Warnings)
+	}
+	for _, w := range r.Warnings {
+		if w.Code != WarningConstraintsNotMet || w.StateName != "slave" {
+			t.Errorf("unexpected warning: %v", w)
+		}
+	}
+	if !reflect.DeepEqual(r.NextMap, prevMap) {
+		t.Errorf("expected no changes, got: %v", r.NextMap)
+	}
+
+	// Adding a node leaves it empty, so fall back to full planning.
+	r = PlanNextMapV2(prevMap,
+		[]string{"a", "b", "c"}, []string{}, []string{"c"},
+		model, PlanNextMapOptions{
+			IncrementalConstraints: true,
+		})
+	if len(r.Warnings) != 1 ||
+		r.Warnings[0].Code != WarningIncrementalImbalanced ||
+		r.Warnings[0].StateName != "master" {
+		t.Errorf("expected fallback warning, got: %v", r.Warnings)
+	}
+	if r.NodeLoads["c"].After <= 0 {
+		t.Errorf("expected full planning to use the added node, got: %v",
+			r.NextMap)
+	}
+
+	// Unless the fallback is disabled.
+	r = PlanNextMapV2(prevMap,
+		[]string{"a", "b", "c"}, []string{}, []string{"c"},
+		model, PlanNextMapOptions{
+			IncrementalConstraints:  true,
+			IncrementalMaxImbalance: -1,
+		})
+	if len(r.Warnings) != 0 || r.NodeLoads["c"].After != 0 {
+		t.Errorf("expected no fallback, got: %v, %v", r.Warnings, r.NextMap)
+	}
+}
+
+func TestPlanNextMapIncrementalConstraintsNodeScorer(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+
+	prevMap := testPlanPrevMap(t, nodes, model, 1)
+
+	// Raise the slaves from 1 to 2, while the NodeScorer avoids "d".
+	r, warnings := PlanNextMapEx(prevMap,
+		nodes, []string{}, []string{}, model, PlanNextMapOptions{
+			ModelStateConstraints:   map[string]int{"slave": 2},
+			IncrementalConstraints:  true,
+			IncrementalMaxImbalance: -1,
+			NodeScorer: NodeScorerFunc(func(s *NodeScore) float64 {
+				if s.Node == "d" {
+					return 1000
+				}
+				return DefaultScoreNode(s)
+			}),
+		})
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	for partitionName, partition := range r {
+		prevPartition := prevMap[partitionName]
+		if len(partition.NodesByState["slave"]) != 2 {
+			t.Errorf("partition: %s, expected 2 slaves, got: %v",
+				partitionName, partition.NodesByState)
+		}
+		if partition.NodesByState["slave"][1] == "d" {
+			t.Errorf("partition: %s, expected the NodeScorer to avoid d,"+
+				" prev: %v, got: %v", partitionName,
+				prevPartition.NodesByState, partition.NodesByState)
+		}
+	}
+}
+
+func TestPlanNextMapIncrementalConstraintsPlacementRules(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d", "e", "f"}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"master": {"a"}, "slave": {"b"}}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"master": {"b"}, "slave": {"c"}}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{
+			"master": {"d"}, "slave": {"e"}}},
+		"3": &Partition{Name: "3", NodesByState: map[string][]string{
+			"master": {"e"}, "slave": {"f"}}},
+	}
+	opts := PlanNextMapOptions{
+		IncrementalConstraints:  true,
+		IncrementalMaxImbalance: -1,
+		PartitionPins: map[string]map[string][]string{
+			"0": {"slave": {"d"}},
+		},
+		AntiAffinityGroups: map[string][]string{"g": {"1", "2"}},
+	}
+
+	// Raise the slaves from 1 to 2, where the existing slave of
+	// partition "0" stays, so its pin can't be met.
+	opts.ModelStateConstraints = map[string]int{"slave": 2}
+	r := PlanNextMapV2(prevMap, nodes, []string{}, []string{}, model, opts)
+	if !reflect.DeepEqual(r.NextMap["0"].NodesByState["slave"],
+		[]string{"b", "d"}) {
+		t.Errorf("expected the pinned node to be added, got: %v",
+			r.NextMap["0"].NodesByState)
+	}
+	if len(StringsIntersectStrings(
+		flattenNodesByState(r.NextMap["1"].NodesByState),
+		flattenNodesByState(r.NextMap["2"].NodesByState))) > 0 {
+		t.Errorf("expected anti-affinity, got: %v, %v",
+			r.NextMap["1"].NodesByState, r.NextMap["2"].NodesByState)
+	}
+	expWarnings := []PlanWarning{{
+		Code: WarningPinNotMet, StateName: "slave",
+		Partition: "0", Constraints: 2,
+	}}
+	if !reflect.DeepEqual(r.Warnings, expWarnings) {
+		t.Errorf("raise, exp warnings: %v, got: %v", expWarnings, r.Warnings)
+	}
+
+	// Lower the slaves from 2 back to 1, which trims the unpinned
+	// slave of partition "0".
+	opts.ModelStateConstraints = map[string]int{"slave": 1}
+	r = PlanNextMapV2(r.NextMap, nodes, []string{}, []string{}, model, opts)
+	if !reflect.DeepEqual(r.NextMap["0"].NodesByState["slave"],
+		[]string{"d"}) {
+		t.Errorf("expected the pinned node to be kept, got: %v",
+			r.NextMap["0"].NodesByState)
+	}
+	if len(r.Warnings) != 0 {
+		t.Errorf("lower, expected no warnings, got: %v", r.Warnings)
+	}
+}
+
+func TestPlanNextMapIncrementalConstraintsNodeCapacities(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c"}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"master": {"a"}}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"master": {"a"}}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{
+			"master": {"a"}}},
+		"3": &Partition{Name: "3", NodesByState: map[string][]string{
+			"master": {"b"}}},
+	}
+
+	tests := []struct {
+		about string
+		opts  PlanNextMapOptions
+		exp   map[string]float64
+	}{
+		{
+			about: "node capacities",
+			opts: PlanNextMapOptions{
+				NodeCapacities: map[string]int{"a": 2, "c": 0},
+			},
+			exp: map[string]float64{"a": 2, "b": 2},
+		},
+		{
+			about: "node state capacities",
+			opts: PlanNextMapOptions{
+				NodeStateCapacities: map[string]map[string]int{
+					"a": {"master": 1},
+					"b": {"master": 1},
+				},
+			},
+			exp: map[string]float64{"a": 1, "b": 1, "c": 2},
+		},
+	}
+
+	for i, test := range tests {
+		opts := test.opts
+		opts.IncrementalConstraints = true
+		opts.IncrementalMaxImbalance = -1
+
+		r := PlanNextMapV2(prevMap, nodes, []string{}, []string{},
+			model, opts)
+		if len(r.Warnings) != 0 {
+			t.Errorf("i: %d, about: %s, expected no warnings, got: %v",
+				i, test.about, r.Warnings)
+		}
+
+		got := map[string]float64{}
+		for node, count := range countStateNodes(r.NextMap, opts)["master"] {
+			if count > 0 {
+				got[node] = count
+			}
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, test.about, test.exp, got)
+		}
+	}
+}
+
+func TestCalcImbalance(t *testing.T) {
+	tests := []struct {
+		nodeCounts  map[string]float64
+		nodes       []string
+		nodeWeights map[string]float64
+		exp         float64
+	}{
+		{nil, []string{"a", "b"}, nil, 0},
+		{map[string]float64{"a": 2, "b": 2}, []string{"a", "b"}, nil, 0},
+		{map[string]float64{"a": 3, "b": 1}, []string{"a", "b"}, nil, 1},
+		{map[string]float64{"a": 4}, []string{"a", "b"}, nil, 2},
+		{map[string]float64{"a": 4, "b": 2}, []string{"a", "b"},
+			map[string]float64{"a": 2}, 0},
+		{map[string]float64{"a": 4, "b": 2}, []string{"a", "b"},
+			map[string]float64{"a": 0}, 0},
+	}
+	for i, c := range tests {
+		got := calcImbalance(c.nodeCounts, c.nodes, c.nodeWeights)
+		if got != c.exp {
+			t.Errorf("i: %d, exp: %f, got: %f", i, c.exp, got)
+		}
+	}
+}
@@ -121,6 +121,77 @@ func CalcPartitionMoves(
 	return moves
 }
 
+// CalcPartitionMovesEx is like CalcPartitionMoves(), but also orders
+// the moves so that, after every move, the number of nodes that hold
+// a state is at most the state's limit in the maxStateHolders, which
+// is keyed by stateName.  For example, a maxStateHolders of
+// {"master": 1} means there's at most one master at a time, so the
+// old master is demoted before the new master is promoted, at the
+// cost of briefly having no master, while a multi-master state might
+// allow more holders, like {"master": 2}.  States that are missing
+// from the maxStateHolders have no limit.
+//
+// The ordering is best effort, so when no remaining move can be taken
+// without exceeding a limit, such as when the begNodesByState already
+// exceeds a limit, then the next move in the order from
+// CalcPartitionMoves() is taken.
+func CalcPartitionMovesEx(
+	states []string,
+	begNodesByState map[string][]string,
+	endNodesByState map[string][]string,
+	favorMinNodes bool,
+	maxStateHolders map[string]int,
+) []NodeStateOp {
+	moves := CalcPartitionMoves(states,
+		begNodesByState, endNodesByState, favorMinNodes)
+	if len(maxStateHolders) <= 0 {
+		return moves
+	}
+
+	// Keyed by node, value is the node's current state.
+	nodeStates := map[string]string{}
+
+	// Keyed by stateName, value is the number of nodes in the state.
+	stateHolders := map[string]int{}
+
+	for stateName, nodes := range begNodesByState {
+		for _, node := range nodes {
+			nodeStates[node] = stateName
+			stateHolders[stateName]++
+		}
+	}
+
+	rv := make([]NodeStateOp, 0, len(moves))
+
+	for len(moves) > 0 {
+		next := 0
+		for i, move := range moves {
+			limit, exists := maxStateHolders[move.State]
+			if move.State == "" || !exists ||
+				stateHolders[move.State] < limit {
+				next = i
+				break
+			}
+		}
+
+		move := moves[next]
+		moves = append(moves[0:next], moves[next+1:]...)
+
+		if prevState, exists := nodeStates[move.Node]; exists {
+			stateHolders[prevState]--
+			delete(nodeStates, move.Node)
+		}
+		if move.State != "" {
+			nodeStates[move.Node] = move.State
+			stateHolders[move.State]++
+		}
+
+		rv = append(rv, move)
+	}
+
+	return rv
+}
+
 func findStateChanges(begStateIdx, endStateIdx int,
 	state string, states []string,
 	begNodesByState map[string][]string,
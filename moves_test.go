@@ -505,3 +505,109 @@ func convertLineToNodesByState(
 
 	return nodesByState
 }
+
+func TestCalcPartitionMovesEx(t *testing.T) {
+	states := []string{"master", "replica"}
+
+	tests := []struct {
+		about           string
+		before          string
+		after           string
+		favorMinNodes   bool
+		maxStateHolders map[string]int
+		exp             []NodeStateOp
+	}{
+		{
+			about:  "swap without limits",
+			before: " a    | b",
+			after:  " b    | a",
+			exp: []NodeStateOp{
+				{"b", "master", "promote"},
+				{"a", "replica", "demote"},
+			},
+		},
+		{
+			about:           "swap with single master",
+			before:          " a    | b",
+			after:           " b    | a",
+			maxStateHolders: map[string]int{"master": 1},
+			exp: []NodeStateOp{
+				{"a", "replica", "demote"},
+				{"b", "master", "promote"},
+			},
+		},
+		{
+			about:           "move with single master",
+			before:          " a",
+			after:           " b",
+			maxStateHolders: map[string]int{"master": 1},
+			exp: []NodeStateOp{
+				{"a", "", "del"},
+				{"b", "master", "add"},
+			},
+		},
+		{
+			about:           "move with single master, favoring min nodes",
+			before:          " a",
+			after:           " b",
+			favorMinNodes:   true,
+			maxStateHolders: map[string]int{"master": 1},
+			exp: []NodeStateOp{
+				{"a", "", "del"},
+				{"b", "master", "add"},
+			},
+		},
+		{
+			about:           "multi-master swap within the limit",
+			before:          " a b  | c",
+			after:           " b c  | a",
+			maxStateHolders: map[string]int{"master": 3},
+			exp: []NodeStateOp{
+				{"c", "master", "promote"},
+				{"a", "replica", "demote"},
+			},
+		},
+		{
+			about:           "multi-master swap at the limit",
+			before:          " a b  | c",
+			after:           " b c  | a",
+			maxStateHolders: map[string]int{"master": 2},
+			exp: []NodeStateOp{
+				{"a", "replica", "demote"},
+				{"c", "master", "promote"},
+			},
+		},
+		{
+			about:           "replica limit",
+			before:          " a    | b",
+			after:           " a    | c",
+			maxStateHolders: map[string]int{"replica": 1},
+			exp: []NodeStateOp{
+				{"b", "", "del"},
+				{"c", "replica", "add"},
+			},
+		},
+		{
+			about:           "limit already exceeded",
+			before:          " a b",
+			after:           " c",
+			maxStateHolders: map[string]int{"master": 1},
+			exp: []NodeStateOp{
+				{"a", "", "del"},
+				{"b", "", "del"},
+				{"c", "master", "add"},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		got := CalcPartitionMovesEx(states,
+			convertLineToNodesByState(test.before, states),
+			convertLineToNodesByState(test.after, states),
+			test.favorMinNodes, test.maxStateHolders)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, test.about, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"reflect"
+)
+
+// A PlanResource is one of the resources planned jointly by
+// PlanNextMaps(), such as one of the indexes or buckets that share a
+// cluster of nodes, each with its own partition map, model and
+// options.
+type PlanResource struct {
+	PrevMap PartitionMap
+	Model   PartitionModel
+	Options PlanNextMapOptions
+}
+
+// PlanNextMaps is like PlanNextMapEx(), but plans several resources
+// jointly on a shared cluster of nodes, so that the total load of
+// each node across all the resources is balanced, instead of only
+// the load of each resource on its own.  The returned nextMaps and
+// warnings are in the same order as the resources.
+//
+// Each resource is planned with PlanNextMapEx() while treating the
+// partitions of the other resources as existing load on the nodes,
+// where the states of the other resources are matched up by their
+// priority order (e.g., the "master" of one model is counted like the
+// "primary" of another model), weighted by the other resources'
+// PartitionWeights, in addition to any NodeBaselineLoads and
+// NodeStateBaselineLoads of the resource's options.  So, the loads of
+// the other resources also count against each resource's
+// NodeCapacities and NodeStateCapacities, which are then the
+// capacities of the nodes for all the resources together.
+//
+// The resources are re-planned in rounds, always starting from their
+// PrevMap, until the nextMaps no longer change or the maximum of the
+// resources' MaxIterations options is reached, where the global
+// MaxIterationsPerPlan is used when the MaxIterations are all 0.
+func PlanNextMaps(
+	resources []*PlanResource,
+	nodesAll []string, // Union of nodesBefore, nodesToAdd, nodesToRemove.
+	nodesToRemove []string,
+	nodesToAdd []string,
+) (nextMaps []PartitionMap, warnings [][]string) {
+	nextMaps = make([]PartitionMap, len(resources))
+	for i, resource := range resources {
+		nextMaps[i] = resource.PrevMap
+	}
+
+	warnings = make([][]string, len(resources))
+
+	maxRounds := 0
+	for _, resource := range resources {
+		if maxRounds < resource.Options.MaxIterations {
+			maxRounds = resource.Options.MaxIterations
+		}
+	}
+	if maxRounds <= 0 {
+		maxRounds = MaxIterationsPerPlan
+	}
+
+	for round := 0; round < maxRounds; round++ {
+		changed := false
+
+		for i, resource := range resources {
+			opts := resource.Options
+			opts.NodeBaselineLoads, opts.NodeStateBaselineLoads =
+				calcBaselineLoads(resources, nextMaps, i)
+
+			nextMap, planWarnings := PlanNextMapEx(resource.PrevMap,
+				nodesAll, nodesToRemove, nodesToAdd, resource.Model, opts)
+			if round == 0 || !reflect.DeepEqual(nextMap, nextMaps[i]) {
+				changed = true
+			}
+
+			nextMaps[i] = nextMap
+			warnings[i] = planWarnings
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	return nextMaps, warnings
+}
+
+// Returns the loads that all the resources other than the resource
+// at index i place on the nodes, given the maps of the resources,
+// added to the resource's own baseline loads, as the
+// NodeBaselineLoads and NodeStateBaselineLoads for the
+// PlanNextMapOptions of the resource at index i.
+func calcBaselineLoads(resources []*PlanResource, maps []PartitionMap,
+	i int) (map[string]float64, map[string]map[string]float64) {
+	nodeLoads := map[string]float64{}
+	for node, load := range resources[i].Options.NodeBaselineLoads {
+		nodeLoads[node] = load
+	}
+
+	nodeStateLoads := map[string]map[string]float64{}
+	for node, stateLoads := range resources[i].Options.NodeStateBaselineLoads {
+		nodeStateLoads[node] = map[string]float64{}
+		for stateName, load := range stateLoads {
+			nodeStateLoads[node][stateName] = load
+		}
+	}
+
+	stateNames := sortStateNames(resources[i].Model)
+
+	for j, other := range resources {
+		if j == i {
+			continue
+		}
+
+		// Keyed by the other resource's stateName, value is the
+		// stateName of the same priority order in this resource.
+		otherStateNames := map[string]string{}
+		for k, otherStateName := range sortStateNames(other.Model) {
+			if k < len(stateNames) {
+				otherStateNames[otherStateName] = stateNames[k]
+			}
+		}
+
+		for otherStateName, nodeCounts := range countStateNodes(maps[j],
+			other.Options) {
+			stateName, exists := otherStateNames[otherStateName]
+			for node, nodeCount := range nodeCounts {
+				if !exists {
+					nodeLoads[node] = nodeLoads[node] + nodeCount
+					continue
+				}
+				stateLoads := nodeStateLoads[node]
+				if stateLoads == nil {
+					stateLoads = map[string]float64{}
+					nodeStateLoads[node] = stateLoads
+				}
+				stateLoads[stateName] = stateLoads[stateName] + nodeCount
+			}
+		}
+	}
+
+	return nodeLoads, nodeStateLoads
+}
@@ -0,0 +1,209 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testMultiPrevMap(prefix string, numPartitions int) PartitionMap {
+	prevMap := PartitionMap{}
+	for i := 0; i < numPartitions; i++ {
+		partitionName := fmt.Sprintf("%s%02d", prefix, i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	return prevMap
+}
+
+func TestPlanNextMaps(t *testing.T) {
+	nodes := []string{"a", "b"}
+
+	resources := []*PlanResource{
+		{
+			PrevMap: testMultiPrevMap("x", 3),
+			Model: PartitionModel{
+				"master": &PartitionModelState{
+					Priority: 0, Constraints: 1,
+				},
+			},
+		},
+		{
+			PrevMap: testMultiPrevMap("y", 3),
+			Model: PartitionModel{
+				"primary": &PartitionModelState{
+					Priority: 0, Constraints: 1,
+				},
+			},
+		},
+	}
+
+	// Planned on their own, both resources favor the same node.
+	totals := map[string]float64{}
+	for _, resource := range resources {
+		nextMap, warnings := PlanNextMapEx(resource.PrevMap,
+			nodes, []string{}, nodes, resource.Model, resource.Options)
+		if len(warnings) != 0 {
+			t.Errorf("expected no warnings, got: %v", warnings)
+		}
+		for _, nodeCounts := range countStateNodes(nextMap,
+			resource.Options) {
+			for node, nodeCount := range nodeCounts {
+				totals[node] = totals[node] + nodeCount
+			}
+		}
+	}
+	if totals["a"] == totals["b"] {
+		t.Errorf("expected separate plans to be imbalanced, got: %v",
+			totals)
+	}
+
+	nextMaps, warnings := PlanNextMaps(resources,
+		nodes, []string{}, nodes)
+	if len(nextMaps) != 2 || len(warnings) != 2 {
+		t.Fatalf("expected 2 nextMaps and warnings, got: %v, %v",
+			nextMaps, warnings)
+	}
+
+	totals = map[string]float64{}
+	for i, nextMap := range nextMaps {
+		if len(warnings[i]) != 0 {
+			t.Errorf("i: %d, expected no warnings, got: %v", i, warnings[i])
+		}
+		if len(nextMap) != 3 {
+			t.Errorf("i: %d, expected 3 partitions, got: %v", i, nextMap)
+		}
+		for partitionName, partition := range nextMap {
+			if len(flattenNodesByState(partition.NodesByState)) != 1 {
+				t.Errorf("i: %d, partition: %s, expected 1 node, got: %v",
+					i, partitionName, partition.NodesByState)
+			}
+		}
+		for _, nodeCounts := range countStateNodes(nextMap,
+			resources[i].Options) {
+			for node, nodeCount := range nodeCounts {
+				totals[node] = totals[node] + nodeCount
+			}
+		}
+	}
+	exp := map[string]float64{"a": 3, "b": 3}
+	if !reflect.DeepEqual(totals, exp) {
+		t.Errorf("expected joint plans to be balanced, exp: %v, got: %v",
+			exp, totals)
+	}
+}
+
+func TestPlanNextMapsNodeCapacities(t *testing.T) {
+	nodes := []string{"a", "b"}
+
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	opts := PlanNextMapOptions{
+		NodeCapacities: map[string]int{"a": 1, "b": 10},
+	}
+
+	// The capacity of node "a" is shared by both resources.
+	nextMaps, warnings := PlanNextMaps([]*PlanResource{
+		{PrevMap: testMultiPrevMap("x", 2), Model: model, Options: opts},
+		{PrevMap: testMultiPrevMap("y", 2), Model: model, Options: opts},
+	}, nodes, []string{}, nodes)
+
+	totals := map[string]float64{}
+	for i, nextMap := range nextMaps {
+		if len(warnings[i]) != 0 {
+			t.Errorf("i: %d, expected no warnings, got: %v", i, warnings[i])
+		}
+		for node, nodeCount := range countStateNodes(nextMap, opts)["master"] {
+			totals[node] = totals[node] + nodeCount
+		}
+	}
+	exp := map[string]float64{"a": 1, "b": 3}
+	if !reflect.DeepEqual(totals, exp) {
+		t.Errorf("expected shared capacities, exp: %v, got: %v", exp, totals)
+	}
+}
+
+func TestCalcBaselineLoads(t *testing.T) {
+	resources := []*PlanResource{
+		{
+			Model: PartitionModel{
+				"master": &PartitionModelState{Priority: 0},
+				"slave":  &PartitionModelState{Priority: 1},
+			},
+		},
+		{
+			Model: PartitionModel{
+				"primary": &PartitionModelState{Priority: 0},
+				"replica": &PartitionModelState{Priority: 1},
+				"backup":  &PartitionModelState{Priority: 2},
+			},
+			Options: PlanNextMapOptions{
+				PartitionWeights:  map[string]int{"1": 3},
+				NodeBaselineLoads: map[string]float64{"c": 2},
+				NodeStateBaselineLoads: map[string]map[string]float64{
+					"a": {"primary": 1},
+				},
+			},
+		},
+	}
+	maps := []PartitionMap{
+		{
+			"0": &Partition{Name: "0", NodesByState: map[string][]string{
+				"master": {"a"}, "slave": {"b"},
+			}},
+		},
+		{
+			"0": &Partition{Name: "0", NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": {"b"}, "backup": {"c"},
+			}},
+			"1": &Partition{Name: "1", NodesByState: map[string][]string{
+				"primary": {"b"}, "replica": {"c"}, "backup": {"a"},
+			}},
+		},
+	}
+
+	nodeLoads, nodeStateLoads := calcBaselineLoads(resources, maps, 0)
+	expNodeLoads := map[string]float64{"a": 3, "c": 1}
+	expNodeStateLoads := map[string]map[string]float64{
+		"a": {"master": 1},
+		"b": {"master": 3, "slave": 1},
+		"c": {"slave": 3},
+	}
+	if !reflect.DeepEqual(nodeLoads, expNodeLoads) ||
+		!reflect.DeepEqual(nodeStateLoads, expNodeStateLoads) {
+		t.Errorf("0, exp: %v, %v, got: %v, %v",
+			expNodeLoads, expNodeStateLoads, nodeLoads, nodeStateLoads)
+	}
+
+	nodeLoads, nodeStateLoads = calcBaselineLoads(resources, maps, 1)
+	expNodeLoads = map[string]float64{"c": 2}
+	expNodeStateLoads = map[string]map[string]float64{
+		"a": {"primary": 2},
+		"b": {"replica": 1},
+	}
+	if !reflect.DeepEqual(nodeLoads, expNodeLoads) ||
+		!reflect.DeepEqual(nodeStateLoads, expNodeStateLoads) {
+		t.Errorf("1, exp: %v, %v, got: %v, %v",
+			expNodeLoads, expNodeStateLoads, nodeLoads, nodeStateLoads)
+	}
+	if resources[1].Options.NodeStateBaselineLoads["a"]["primary"] != 1 {
+		t.Errorf("expected the options to be unchanged, got: %v",
+			resources[1].Options.NodeStateBaselineLoads)
+	}
+}
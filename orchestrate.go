@@ -14,6 +14,7 @@ package blance
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -115,6 +116,23 @@ type OrchestratorOptions struct {
 
 	// See blance.CalcPartitionMoves(favorMinNodes).
 	FavorMinNodes bool
+
+	// PartitionsToAdd are the names of partitions that are being
+	// created, which are allowed to be in the endMap but not in the
+	// begMap, and which will be assigned to their nodes from scratch.
+	PartitionsToAdd []string
+
+	// PartitionsToRemove are the names of partitions that are being
+	// deleted, which are allowed to be in the begMap but not in the
+	// endMap, and which will be removed ("del") from all their nodes.
+	PartitionsToRemove []string
+
+	// MaxStateHolders is optional and is keyed by stateName, where the
+	// value is the most nodes that may hold a partition in that state
+	// at the same time while the partition's moves are taken, such as
+	// {"master": 1} to never have two masters of a partition.  See
+	// blance.CalcPartitionMovesEx(maxStateHolders).
+	MaxStateHolders map[string]int
 }
 
 // OrchestratorProgress represents progress counters and/or error
@@ -237,6 +255,12 @@ type partitionMoveReq struct {
 // The nodesAll must be a union or superset of all the nodes during
 // the orchestration (nodes added, removed, unchanged).
 //
+// An error is returned, before any moves are started, when a
+// partition is in only one of the begMap and endMap (unless it's in
+// the options.PartitionsToAdd or PartitionsToRemove), or when a
+// partition is assigned to a node that's not in the nodesAll, or to
+// a state that's not in the model.
+//
 // The findMove callback is invoked when OrchestrateMoves needs to
 // find the best move for a node from amongst a set of available
 // moves.
@@ -249,8 +273,9 @@ func OrchestrateMoves(
 	assignPartition AssignPartitionFunc,
 	findMove FindMoveFunc,
 ) (*Orchestrator, error) {
-	if len(begMap) != len(endMap) {
-		return nil, fmt.Errorf("mismatched begMap and endMap")
+	err := validateOrchestrateMoves(model, options, nodesAll, begMap, endMap)
+	if err != nil {
+		return nil, err
 	}
 
 	// Populate the mapNodeToPartitionMoveReqCh, keyed by node name.
@@ -267,15 +292,18 @@ func OrchestrateMoves(
 	// As an analogy, this step calculates a bunch of airplane flight
 	// plans, without consideration to what the other airplanes are
 	// doing, where each flight plan has multi-city, multi-leg hops.
+	//
+	// A partition that's being created has an empty begin state,
+	// and a partition that's being deleted has an empty end state.
 	mapPartitionToNextMoves := map[string]*NextMoves{}
 
-	for partitionName, begPartition := range begMap {
-		endPartition := endMap[partitionName]
-
-		moves := CalcPartitionMoves(states,
-			begPartition.NodesByState,
-			endPartition.NodesByState,
+	addNextMoves := func(partitionName string,
+		begNodesByState, endNodesByState map[string][]string) {
+		moves := CalcPartitionMovesEx(states,
+			begNodesByState,
+			endNodesByState,
 			options.FavorMinNodes,
+			options.MaxStateHolders,
 		)
 
 		mapPartitionToNextMoves[partitionName] = &NextMoves{
@@ -285,6 +313,22 @@ func OrchestrateMoves(
 		}
 	}
 
+	for partitionName, begPartition := range begMap {
+		var endNodesByState map[string][]string
+		if endPartition, exists := endMap[partitionName]; exists {
+			endNodesByState = endPartition.NodesByState
+		}
+
+		addNextMoves(partitionName,
+			begPartition.NodesByState, endNodesByState)
+	}
+
+	for partitionName, endPartition := range endMap {
+		if _, exists := begMap[partitionName]; !exists {
+			addNextMoves(partitionName, nil, endPartition.NodesByState)
+		}
+	}
+
 	o := &Orchestrator{
 		model:           model,
 		options:         options,
@@ -341,6 +385,115 @@ func OrchestrateMoves(
 	return o, nil
 }
 
+// validateOrchestrateMoves returns an error if the inputs to
+// OrchestrateMoves() are inconsistent, which would otherwise lead to
+// an orchestration that never finishes.  The partitions are checked
+// in sorted order, so that the error is repeatable.
+func validateOrchestrateMoves(
+	model PartitionModel,
+	options OrchestratorOptions,
+	nodesAll []string,
+	begMap PartitionMap,
+	endMap PartitionMap,
+) error {
+	partitionsToAdd := StringsToMap(options.PartitionsToAdd)
+	partitionsToRemove := StringsToMap(options.PartitionsToRemove)
+
+	nodes := StringsToMap(nodesAll)
+
+	maxStateHoldersNames := make([]string, 0, len(options.MaxStateHolders))
+	for stateName := range options.MaxStateHolders {
+		maxStateHoldersNames = append(maxStateHoldersNames, stateName)
+	}
+	sort.Strings(maxStateHoldersNames)
+
+	for _, stateName := range maxStateHoldersNames {
+		if _, exists := model[stateName]; !exists {
+			return fmt.Errorf("state: %s, of the MaxStateHolders,"+
+				" is not in the model", stateName)
+		}
+		if options.MaxStateHolders[stateName] <= 0 {
+			return fmt.Errorf("state: %s, of the MaxStateHolders,"+
+				" must be > 0", stateName)
+		}
+	}
+
+	validatePartition := func(mapName, partitionName string,
+		partition *Partition) error {
+		if partition == nil {
+			return fmt.Errorf("partition: %s, in the %s, is nil",
+				partitionName, mapName)
+		}
+
+		stateNames := make([]string, 0, len(partition.NodesByState))
+		for stateName := range partition.NodesByState {
+			stateNames = append(stateNames, stateName)
+		}
+		sort.Strings(stateNames)
+
+		for _, stateName := range stateNames {
+			_, exists := model[stateName]
+			if !exists {
+				return fmt.Errorf("state: %s, of partition: %s,"+
+					" in the %s, is not in the model",
+					stateName, partitionName, mapName)
+			}
+			for _, node := range partition.NodesByState[stateName] {
+				if !nodes[node] {
+					return fmt.Errorf("node: %s, of partition: %s,"+
+						" in the %s, is not in nodesAll",
+						node, partitionName, mapName)
+				}
+			}
+		}
+		return nil
+	}
+
+	partitionNames := make([]string, 0, len(begMap))
+	for partitionName := range begMap {
+		partitionNames = append(partitionNames, partitionName)
+	}
+	for partitionName := range endMap {
+		if _, exists := begMap[partitionName]; !exists {
+			partitionNames = append(partitionNames, partitionName)
+		}
+	}
+	sort.Strings(partitionNames)
+
+	for _, partitionName := range partitionNames {
+		_, begExists := begMap[partitionName]
+		_, endExists := endMap[partitionName]
+
+		if !endExists && !partitionsToRemove[partitionName] {
+			return fmt.Errorf("mismatched begMap and endMap,"+
+				" partition: %s, is only in the begMap,"+
+				" but is not in the PartitionsToRemove", partitionName)
+		}
+		if !begExists && !partitionsToAdd[partitionName] {
+			return fmt.Errorf("mismatched begMap and endMap,"+
+				" partition: %s, is only in the endMap,"+
+				" but is not in the PartitionsToAdd", partitionName)
+		}
+
+		if begExists {
+			err := validatePartition("begMap",
+				partitionName, begMap[partitionName])
+			if err != nil {
+				return err
+			}
+		}
+		if endExists {
+			err := validatePartition("endMap",
+				partitionName, endMap[partitionName])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // Stop asynchronously requests the orchestrator to stop, where the
 // caller will eventually see a closed progress channel.
 func (o *Orchestrator) Stop() {
@@ -2,6 +2,7 @@ package blance
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 )
@@ -1200,3 +1201,267 @@ func TestOrchestrateMoves(t *testing.T) {
 		}
 	}
 }
+
+func TestOrchestrateAddRemovePartitions(t *testing.T) {
+	begMap := PartitionMap{
+		"00": &Partition{
+			Name: "00",
+			NodesByState: map[string][]string{
+				"master":  {"a"},
+				"replica": {"b"},
+			},
+		},
+		"01": &Partition{
+			Name: "01",
+			NodesByState: map[string][]string{
+				"master":  {"b"},
+				"replica": {"a"},
+			},
+		},
+	}
+	endMap := PartitionMap{
+		"00": &Partition{
+			Name: "00",
+			NodesByState: map[string][]string{
+				"master":  {"a"},
+				"replica": {"b"},
+			},
+		},
+		"02": &Partition{
+			Name: "02",
+			NodesByState: map[string][]string{
+				"master":  {"b"},
+				"replica": {"a"},
+			},
+		},
+	}
+
+	tests := []struct {
+		About   string
+		options OrchestratorOptions
+		expErr  bool
+	}{
+		{"undeclared partitions", OrchestratorOptions{}, true},
+		{"undeclared partition to add", OrchestratorOptions{
+			PartitionsToRemove: []string{"01"},
+		}, true},
+		{"undeclared partition to remove", OrchestratorOptions{
+			PartitionsToAdd: []string{"02"},
+		}, true},
+		{"declared partitions", OrchestratorOptions{
+			PartitionsToAdd:    []string{"02"},
+			PartitionsToRemove: []string{"01"},
+		}, false},
+	}
+	for i, c := range tests {
+		currStates, _, assignPartitionFunc := testMkFuncs()
+
+		o, err := OrchestrateMoves(mrPartitionModel, c.options,
+			[]string{"a", "b"}, begMap, endMap,
+			assignPartitionFunc, LowestWeightPartitionMoveForNode)
+		if c.expErr {
+			if err == nil || o != nil {
+				t.Errorf("i: %d, about: %s, expected err", i, c.About)
+			}
+			continue
+		}
+		if err != nil || o == nil {
+			t.Errorf("i: %d, about: %s, expected no err, got: %v",
+				i, c.About, err)
+			continue
+		}
+
+		for progress := range o.ProgressCh() {
+			if len(progress.Errors) > 0 {
+				t.Errorf("i: %d, about: %s, progress errors: %v",
+					i, c.About, progress.Errors)
+			}
+		}
+		o.Stop()
+
+		expStates := map[string]map[string]string{
+			"01": {"a": "", "b": ""},
+			"02": {"a": "replica", "b": "master"},
+		}
+		if !reflect.DeepEqual(currStates, expStates) {
+			t.Errorf("i: %d, about: %s, expStates: %v, got: %v",
+				i, c.About, expStates, currStates)
+		}
+	}
+}
+
+func TestOrchestrateValidation(t *testing.T) {
+	mkMap := func(partitionName string,
+		nodesByState map[string][]string) PartitionMap {
+		return PartitionMap{
+			partitionName: &Partition{
+				Name:         partitionName,
+				NodesByState: nodesByState,
+			},
+		}
+	}
+
+	tests := []struct {
+		About    string
+		nodesAll []string
+		begMap   PartitionMap
+		endMap   PartitionMap
+		expErr   string
+	}{
+		{"ok",
+			[]string{"a", "b"},
+			mkMap("00", map[string][]string{"master": {"a"}}),
+			mkMap("00", map[string][]string{"master": {"b"}}),
+			"",
+		},
+		{"partition only in begMap",
+			[]string{"a", "b"},
+			mkMap("00", map[string][]string{"master": {"a"}}),
+			mkMap("01", map[string][]string{"master": {"b"}}),
+			"mismatched begMap and endMap, partition: 00," +
+				" is only in the begMap, but is not in the PartitionsToRemove",
+		},
+		{"partition only in endMap",
+			[]string{"a", "b"},
+			PartitionMap{},
+			mkMap("01", map[string][]string{"master": {"b"}}),
+			"mismatched begMap and endMap, partition: 01," +
+				" is only in the endMap, but is not in the PartitionsToAdd",
+		},
+		{"begMap node missing from nodesAll",
+			[]string{"b"},
+			mkMap("00", map[string][]string{"master": {"a"}}),
+			mkMap("00", map[string][]string{"master": {"b"}}),
+			"node: a, of partition: 00, in the begMap, is not in nodesAll",
+		},
+		{"endMap node missing from nodesAll",
+			[]string{"a"},
+			mkMap("00", map[string][]string{"master": {"a"}}),
+			mkMap("00", map[string][]string{"master": {"b"}}),
+			"node: b, of partition: 00, in the endMap, is not in nodesAll",
+		},
+		{"state missing from model",
+			[]string{"a", "b"},
+			mkMap("00", map[string][]string{"master": {"a"}}),
+			mkMap("00", map[string][]string{"primary": {"b"}}),
+			"state: primary, of partition: 00, in the endMap," +
+				" is not in the model",
+		},
+		{"nil partition",
+			[]string{"a", "b"},
+			mkMap("00", map[string][]string{"master": {"a"}}),
+			PartitionMap{"00": nil},
+			"partition: 00, in the endMap, is nil",
+		},
+	}
+	for i, c := range tests {
+		_, _, assignPartitionFunc := testMkFuncs()
+
+		o, err := OrchestrateMoves(mrPartitionModel, options1,
+			c.nodesAll, c.begMap, c.endMap,
+			assignPartitionFunc, LowestWeightPartitionMoveForNode)
+		if c.expErr == "" {
+			if err != nil || o == nil {
+				t.Errorf("i: %d, about: %s, expected no err, got: %v",
+					i, c.About, err)
+				continue
+			}
+			for range o.ProgressCh() {
+			}
+			o.Stop()
+			continue
+		}
+		if err == nil || o != nil {
+			t.Errorf("i: %d, about: %s, expected err", i, c.About)
+			continue
+		}
+		if err.Error() != c.expErr {
+			t.Errorf("i: %d, about: %s, expErr: %s, got: %v",
+				i, c.About, c.expErr, err)
+		}
+	}
+}
+
+func TestOrchestrateMaxStateHolders(t *testing.T) {
+	begMap := PartitionMap{
+		"00": &Partition{
+			Name: "00",
+			NodesByState: map[string][]string{
+				"master":  {"a"},
+				"replica": {"b"},
+			},
+		},
+	}
+	endMap := PartitionMap{
+		"00": &Partition{
+			Name: "00",
+			NodesByState: map[string][]string{
+				"master":  {"b"},
+				"replica": {"a"},
+			},
+		},
+	}
+
+	tests := []struct {
+		About           string
+		MaxStateHolders map[string]int
+		expErr          string
+		expRecs         []assignPartitionRec
+	}{
+		{"no limits", nil, "",
+			[]assignPartitionRec{
+				{"00", "b", "master", "promote"},
+				{"00", "a", "replica", "demote"},
+			},
+		},
+		{"single master", map[string]int{"master": 1}, "",
+			[]assignPartitionRec{
+				{"00", "a", "replica", "demote"},
+				{"00", "b", "master", "promote"},
+			},
+		},
+		{"state missing from model", map[string]int{"primary": 1},
+			"state: primary, of the MaxStateHolders, is not in the model",
+			nil,
+		},
+		{"limit too low", map[string]int{"master": 0},
+			"state: master, of the MaxStateHolders, must be > 0",
+			nil,
+		},
+	}
+	for i, c := range tests {
+		_, assignPartitionRecs, assignPartitionFunc := testMkFuncs()
+
+		options := options1
+		options.MaxStateHolders = c.MaxStateHolders
+
+		o, err := OrchestrateMoves(mrPartitionModel, options,
+			[]string{"a", "b"}, begMap, endMap,
+			assignPartitionFunc, LowestWeightPartitionMoveForNode)
+		if c.expErr != "" {
+			if err == nil || o != nil || err.Error() != c.expErr {
+				t.Errorf("i: %d, about: %s, expErr: %s, got: %v",
+					i, c.About, c.expErr, err)
+			}
+			continue
+		}
+		if err != nil || o == nil {
+			t.Errorf("i: %d, about: %s, expected no err, got: %v",
+				i, c.About, err)
+			continue
+		}
+
+		for progress := range o.ProgressCh() {
+			if len(progress.Errors) > 0 {
+				t.Errorf("i: %d, about: %s, progress errors: %v",
+					i, c.About, progress.Errors)
+			}
+		}
+		o.Stop()
+
+		if !reflect.DeepEqual(assignPartitionRecs["00"], c.expRecs) {
+			t.Errorf("i: %d, about: %s, expRecs: %v, got: %v",
+				i, c.About, c.expRecs, assignPartitionRecs["00"])
+		}
+	}
+}
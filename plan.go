@@ -13,6 +13,7 @@ package blance
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"sort"
 	"strconv"
@@ -20,7 +21,10 @@ import (
 
 // MaxIterationsPerPlan controls how many iterations blance will
 // attempt to try to converge to a stabilized plan.  Usually, blance
-// only needs only 1 or 2 iterations.
+// only needs only 1 or 2 iterations.  It's the default when the
+// PlanNextMapOptions.MaxIterations is 0; applications that plan
+// concurrently should use the PlanNextMapOptions.MaxIterations
+// instead of changing this global var.
 var MaxIterationsPerPlan = 10
 
 func planNextMapEx(
@@ -30,19 +34,72 @@ func planNextMapEx(
 	nodesToAdd []string,
 	model PartitionModel,
 	opts PlanNextMapOptions,
-) (nextMap PartitionMap, warnings []string) {
-	for i := 0; i < MaxIterationsPerPlan; i++ { // Loop for convergence.
+) (nextMap PartitionMap, warnings []PlanWarning, stats PlanStats) {
+	if len(opts.PartitionsToAdd) > 0 || len(opts.PartitionsToRemove) > 0 {
+		prevMap = addRemovePartitions(prevMap,
+			opts.PartitionsToAdd, opts.PartitionsToRemove)
+	}
+
+	if opts.PromoteDemoteOnly {
+		nextMap, warnings = planPromoteDemote(prevMap, nodesAll,
+			nodesToRemove, model, opts)
+		return nextMap, warnings, PlanStats{Iterations: 1, Converged: true}
+	}
+
+	if len(opts.NodeWarmUps) > 0 {
+		opts.NodeCapacities = calcWarmUpCapacities(prevMap,
+			StringsRemoveStrings(nodesAll, nodesToRemove), model, opts)
+	}
+
+	// Warnings from before the full planning.
+	var preWarnings []PlanWarning
+
+	if opts.IncrementalConstraints {
+		incMap, incWarnings, imbalancedStateName :=
+			planIncremental(prevMap, nodesAll, nodesToRemove, model, opts,
+				nil)
+		if imbalancedStateName == "" {
+			return incMap, incWarnings, PlanStats{Iterations: 1, Converged: true}
+		}
+
+		preWarnings = append(preWarnings, PlanWarning{
+			Code:      WarningIncrementalImbalanced,
+			StateName: imbalancedStateName,
+		})
+	}
+
+	origPrevMap := prevMap
+	nodesNext := StringsRemoveStrings(nodesAll, nodesToRemove)
+
+	maxIterations := opts.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = MaxIterationsPerPlan
+	}
+
+	for i := 0; i < maxIterations; i++ { // Loop for convergence.
 		nextMap, warnings = planNextMapInnerEx(prevMap,
 			nodesAll, nodesToRemove, nodesToAdd, model, opts)
+		stats.Iterations++
 		if reflect.DeepEqual(nextMap, prevMap) {
+			stats.Converged = true
 			break
 		}
 		prevMap = nextMap
-		nodesAll = StringsRemoveStrings(nodesAll, nodesToRemove)
+		nodesAll = nodesNext
 		nodesToRemove = []string{}
 		nodesToAdd = []string{}
 	}
-	return nextMap, warnings
+
+	if opts.LocalSearch != nil {
+		nextMap = refineMap(origPrevMap, nextMap, nodesNext, model, opts)
+		warnings = refineWarnings(warnings, nextMap, model, opts)
+	}
+
+	if preWarnings != nil {
+		warnings = append(preWarnings, warnings...)
+	}
+
+	return nextMap, warnings, stats
 }
 
 func planNextMapInnerEx(
@@ -52,8 +109,8 @@ func planNextMapInnerEx(
 	nodesToAdd []string,
 	model PartitionModel,
 	opts PlanNextMapOptions,
-) (PartitionMap, []string) {
-	warnings := []string{}
+) (PartitionMap, []PlanWarning) {
+	warnings := []PlanWarning{}
 
 	nodePositions := map[string]int{}
 	for i, node := range nodesAll {
@@ -64,6 +121,8 @@ func planNextMapInnerEx(
 
 	hierarchyChildren := mapParentsToMapChildren(opts.NodeHierarchy)
 
+	nodeWeights := mergeWeights(opts.NodeWeights, opts.NodeWeightsFloat)
+
 	// Start by filling out nextPartitions as a deep clone of
 	// prevMap.Partitions, but filter out the to-be-removed nodes.
 	nextPartitions := prevMap.toArrayCopy()
@@ -74,10 +133,49 @@ func planNextMapInnerEx(
 	}
 	sort.Sort(&partitionSorter{a: nextPartitions})
 
+	nextPartitionsByName := make(map[string]*Partition)
+	for _, partition := range nextPartitions {
+		nextPartitionsByName[partition.Name] = partition
+	}
+
+	// Keyed by the partitionName of an affinity group's leader, value
+	// is the group's partitions, with the leader first.
+	affinityGroups := mapAffinityGroups(opts.AffinityGroups, nextPartitionsByName)
+
+	// Keyed by partitionName, true when the partition is an affinity
+	// group member that follows the assignments of its leader.
+	affinityFollowers := map[string]bool{}
+	for _, members := range affinityGroups {
+		for _, member := range members[1:] {
+			affinityFollowers[member.Name] = true
+		}
+	}
+
+	// Keyed by partitionName, value is the other partitions that
+	// share an anti-affinity group with the partition.
+	antiAffinityPartitions := mapAntiAffinityPartitions(opts.AntiAffinityGroups)
+
 	// Key is stateName, value is {node: count}.
-	var stateNodeCounts map[string]map[string]int
+	var stateNodeCounts map[string]map[string]float64
+
+	stateNodeCounts = countStateNodes(prevMap, opts)
+
+	addBaselineStateNodeCounts(stateNodeCounts, opts)
 
-	stateNodeCounts = countStateNodes(prevMap, opts.PartitionWeights)
+	// Key is stateName, then resource name, value is {node: amount}.
+	var stateResourceNodeCounts map[string]map[string]map[string]int
+
+	var resourceUnits map[string]float64
+	var nodeResourceScales map[string]map[string]float64
+
+	if opts.PartitionResources != nil {
+		stateResourceNodeCounts =
+			countStateNodeResources(prevMap, opts.PartitionResources)
+
+		resourceUnits, nodeResourceScales =
+			calcResourceScales(prevMap, nodesNext,
+				opts.PartitionResources, opts.NodeResources)
+	}
 
 	// Helper function that returns an ordered array of candidates
 	// nodes to assign to a partition, ordered by best heuristic fit.
@@ -87,27 +185,16 @@ func planNextMapInnerEx(
 		constraints int,
 		nodeToNodeCounts map[string]map[string]int,
 	) []string {
-		stickiness := 1.5
-		if opts.PartitionWeights != nil {
-			w, exists := opts.PartitionWeights[partition.Name]
-			if exists {
-				stickiness = float64(w)
-			} else if opts.StateStickiness != nil {
-				s, exists := opts.StateStickiness[stateName]
-				if exists {
-					stickiness = float64(s)
-				}
-			}
+		// An affinity group is placed as one combined partition.
+		members := affinityGroups[partition.Name]
+		if members == nil {
+			members = []*Partition{partition}
 		}
 
+		stickiness := getStickiness(partition.Name, stateName, opts)
+
 		// Keyed by node, value is sum of partitions on that node.
-		nodePartitionCounts := make(map[string]int)
-		for _, nodeCounts := range stateNodeCounts {
-			for node, nodeCount := range nodeCounts {
-				nodePartitionCounts[node] =
-					nodePartitionCounts[node] + nodeCount
-			}
-		}
+		nodePartitionCounts := countNodePartitions(stateNodeCounts, opts)
 
 		topPriorityStateName := ""
 		for stateName, state := range model {
@@ -141,6 +228,53 @@ func planNextMapInnerEx(
 
 		candidateNodes = excludeHigherPriorityNodes(candidateNodes)
 
+		// Filter out nodes that may not be assigned the partition in
+		// this state, such as nodes that are draining the state.
+		excludeDisallowedNodes := func(remainingNodes []string) []string {
+			if opts.NodeDrains == nil && opts.NodeAllowedStates == nil {
+				return remainingNodes
+			}
+			rv := make([]string, 0, len(remainingNodes))
+			for _, node := range remainingNodes {
+				if nodeAllowsState(node, stateName, opts) {
+					rv = append(rv, node)
+				}
+			}
+			return rv
+		}
+
+		numAllowedNodes := len(candidateNodes)
+
+		candidateNodes = excludeDisallowedNodes(candidateNodes)
+
+		notAllowed := len(candidateNodes) < numAllowedNodes
+
+		// Filter out nodes that don't have enough remaining capacity
+		// to be assigned the partition in this state.
+		excludeOverCapacityNodes := func(remainingNodes []string) []string {
+			if opts.NodeCapacities == nil && opts.NodeStateCapacities == nil &&
+				opts.NodeDrains == nil {
+				return remainingNodes
+			}
+			rv := make([]string, 0, len(remainingNodes))
+			for _, node := range remainingNodes {
+				if nodeHasCapacity(node, members, stateName,
+					stateNodeCounts[stateName], nodePartitionCounts, opts) {
+					rv = append(rv, node)
+				}
+			}
+			return rv
+		}
+
+		numCandidateNodes := len(candidateNodes)
+
+		candidateNodes = excludeOverCapacityNodes(candidateNodes)
+
+		overCapacity := len(candidateNodes) < numCandidateNodes
+
+		rules := newPlacementRules(partition.Name, stateName,
+			nextPartitionsByName, antiAffinityPartitions, opts)
+
 		sort.Sort(&nodeSorter{
 			stateName:           stateName,
 			partition:           partition,
@@ -150,11 +284,18 @@ func planNextMapInnerEx(
 			nodeToNodeCounts:    nodeToNodeCounts,
 			nodePartitionCounts: nodePartitionCounts,
 			nodePositions:       nodePositions,
-			nodeWeights:         opts.NodeWeights,
+			nodeWeights:         nodeWeights,
 			stickiness:          stickiness,
+			nodeScorer:          opts.NodeScorer,
 			a:                   candidateNodes,
+
+			nodeResourceCounts: stateResourceNodeCounts[stateName],
+			resourceUnits:      resourceUnits,
+			nodeResourceScales: nodeResourceScales,
 		})
 
+		candidateNodes = rules.order(candidateNodes)
+
 		if opts.HierarchyRules != nil {
 			hierarchyNodes := []string{}
 
@@ -172,6 +313,11 @@ func planNextMapInnerEx(
 					StringsIntersectStrings(hierarchyCandidates, nodesNext)
 				hierarchyCandidates =
 					excludeHigherPriorityNodes(hierarchyCandidates)
+				hierarchyCandidates =
+					excludeDisallowedNodes(hierarchyCandidates)
+				hierarchyCandidates =
+					excludeOverCapacityNodes(hierarchyCandidates)
+				hierarchyCandidates = rules.filter(hierarchyCandidates)
 
 				sort.Sort(&nodeSorter{
 					stateName:           stateName,
@@ -182,9 +328,14 @@ func planNextMapInnerEx(
 					nodeToNodeCounts:    nodeToNodeCounts,
 					nodePartitionCounts: nodePartitionCounts,
 					nodePositions:       nodePositions,
-					nodeWeights:         opts.NodeWeights,
+					nodeWeights:         nodeWeights,
 					stickiness:          stickiness,
+					nodeScorer:          opts.NodeScorer,
 					a:                   hierarchyCandidates,
+
+					nodeResourceCounts: stateResourceNodeCounts[stateName],
+					resourceUnits:      resourceUnits,
+					nodeResourceScales: nodeResourceScales,
 				})
 
 				if len(hierarchyCandidates) > 0 {
@@ -201,13 +352,32 @@ func planNextMapInnerEx(
 
 		if len(candidateNodes) >= constraints {
 			candidateNodes = candidateNodes[0:constraints]
+		} else if overCapacity {
+			warnings = append(warnings, PlanWarning{
+				Code:        WarningInsufficientCapacity,
+				StateName:   stateName,
+				Partition:   partition.Name,
+				Constraints: constraints,
+			})
+		} else if notAllowed {
+			warnings = append(warnings, PlanWarning{
+				Code:        WarningStateNotAllowed,
+				StateName:   stateName,
+				Partition:   partition.Name,
+				Constraints: constraints,
+			})
 		} else {
-			warnings = append(warnings,
-				fmt.Sprintf("could not meet constraints: %d,"+
-					" stateName: %s, partitionName: %s",
-					constraints, stateName, partition.Name))
+			warnings = append(warnings, PlanWarning{
+				Code:        WarningConstraintsNotMet,
+				StateName:   stateName,
+				Partition:   partition.Name,
+				Constraints: constraints,
+			})
 		}
 
+		warnings = append(warnings, rules.warnings(partition.Name,
+			stateName, constraints, candidateNodes)...)
+
 		// Keep nodeToNodeCounts updated.
 		for _, candidateNode := range candidateNodes {
 			m, exists := nodeToNodeCounts[topPriorityNode]
@@ -227,40 +397,45 @@ func planNextMapInnerEx(
 	assignStateToPartitions := func(stateName string, constraints int) {
 		// Sort the partitions to help reach a better assignment.
 		p := &partitionSorter{
-			stateName:        stateName,
-			prevMap:          prevMap,
-			nodesToRemove:    nodesToRemove,
-			nodesToAdd:       nodesToAdd,
-			partitionWeights: opts.PartitionWeights,
-			a:                append([]*Partition(nil), nextPartitions...),
+			stateName:      stateName,
+			prevMap:        prevMap,
+			nodesToRemove:  nodesToRemove,
+			nodesToAdd:     nodesToAdd,
+			opts:           opts,
+			affinityGroups: affinityGroups,
+			a:              append([]*Partition(nil), nextPartitions...),
 		}
 		sort.Sort(p)
 
 		// Key is higherPriorityNode, value is {lowerPriorityNode: count}.
 		nodeToNodeCounts := make(map[string]map[string]int)
 
-		for _, partition := range p.a {
-			partitionWeight := 1
-			if opts.PartitionWeights != nil {
-				w, exists := opts.PartitionWeights[partition.Name]
-				if exists {
-					partitionWeight = w
-				}
+		// Assigns the nodes to the partition in the stateName, keeping
+		// the counts updated.
+		assignNodes := func(partition *Partition, nodesToAssign []string) {
+			partitionWeight := func(stateName string) float64 {
+				return getPartitionWeight(partition.Name, stateName, opts)
 			}
 
+			partitionResources := opts.PartitionResources[partition.Name]
+
 			incStateNodeCounts := func(stateName string, nodes []string) {
 				adjustStateNodeCounts(stateNodeCounts, stateName, nodes,
-					partitionWeight)
+					partitionWeight(stateName))
+				if stateResourceNodeCounts != nil {
+					adjustStateNodeResources(stateResourceNodeCounts,
+						stateName, nodes, partitionResources, 1)
+				}
 			}
 			decStateNodeCounts := func(stateName string, nodes []string) {
 				adjustStateNodeCounts(stateNodeCounts, stateName, nodes,
-					-partitionWeight)
+					-partitionWeight(stateName))
+				if stateResourceNodeCounts != nil {
+					adjustStateNodeResources(stateResourceNodeCounts,
+						stateName, nodes, partitionResources, -1)
+				}
 			}
 
-			nodesToAssign :=
-				findBestNodes(partition,
-					stateName, constraints, nodeToNodeCounts)
-
 			partition.NodesByState =
 				removeNodesFromNodesByState(partition.NodesByState,
 					partition.NodesByState[stateName],
@@ -274,25 +449,39 @@ func planNextMapInnerEx(
 
 			incStateNodeCounts(stateName, nodesToAssign)
 		}
-	}
 
-	// Run through the sorted partition states (master, slave, etc)
-	// that have constraints and invoke assignStateToPartitions().
-	for _, stateName := range sortStateNames(model) {
-		constraints := 0
+		for _, partition := range p.a {
+			if affinityFollowers[partition.Name] {
+				continue
+			}
 
-		modelState, exists := model[stateName]
-		if exists && modelState != nil {
-			constraints = modelState.Constraints
-		}
-		if opts.ModelStateConstraints != nil {
-			modelStateConstraints, exists := opts.ModelStateConstraints[stateName]
-			if exists {
-				constraints = modelStateConstraints
+			partitionConstraints, exists :=
+				getPartitionConstraints(partition.Name, stateName,
+					constraints, opts)
+			if partitionConstraints <= 0 && !exists {
+				continue
 			}
+
+			nodesToAssign :=
+				findBestNodes(partition,
+					stateName, partitionConstraints, nodeToNodeCounts)
+
+			for _, member := range affinityGroups[partition.Name] {
+				if member != partition {
+					assignNodes(member, append([]string{}, nodesToAssign...))
+				}
+			}
+
+			assignNodes(partition, nodesToAssign)
 		}
+	}
 
-		if constraints > 0 {
+	// Run through the sorted partition states (master, slave, etc)
+	// that have constraints and invoke assignStateToPartitions().
+	for _, stateName := range sortStateNames(model) {
+		constraints := getStateConstraints(stateName, model, opts)
+		if constraints > 0 ||
+			hasPartitionConstraints(stateName, opts) {
 			assignStateToPartitions(stateName, constraints)
 		}
 	}
@@ -324,12 +513,12 @@ func copyNodesByState(nbs map[string][]string) map[string][]string {
 	return rv
 }
 
-func adjustStateNodeCounts(stateNodeCounts map[string]map[string]int,
-	stateName string, nodes []string, amt int) {
+func adjustStateNodeCounts(stateNodeCounts map[string]map[string]float64,
+	stateName string, nodes []string, amt float64) {
 	for _, node := range nodes {
 		s, exists := stateNodeCounts[stateName]
 		if !exists || s == nil {
-			s = make(map[string]int)
+			s = make(map[string]float64)
 			stateNodeCounts[stateName] = s
 		}
 		s[node] = s[node] + amt
@@ -342,35 +531,683 @@ func adjustStateNodeCounts(stateNodeCounts map[string]map[string]int,
 // then return value will be...
 //   { "master": { "a": 1, "b": 1 },
 //     "slave": { "b": 1, "c": 2 } }
+// The counts are weighted by the optional partition weights from the
+// opts.
 func countStateNodes(
 	partitionMap PartitionMap,
-	partitionWeights map[string]int,
-) map[string]map[string]int {
-	rv := make(map[string]map[string]int)
+	opts PlanNextMapOptions,
+) map[string]map[string]float64 {
+	rv := make(map[string]map[string]float64)
 	for partitionName, partition := range partitionMap {
 		for stateName, nodes := range partition.NodesByState {
 			s := rv[stateName]
 			if s == nil {
-				s = make(map[string]int)
+				s = make(map[string]float64)
 				rv[stateName] = s
 			}
+			partitionWeight :=
+				getPartitionWeight(partitionName, stateName, opts)
 			for _, node := range nodes {
-				partitionWeight := 1
-				if partitionWeights != nil {
-					w, exists := partitionWeights[partitionName]
-					if exists {
-						partitionWeight = w
+				s[node] = s[node] + partitionWeight
+			}
+		}
+	}
+	return rv
+}
+
+// Adds the NodeStateBaselineLoads of the options, if any, into the
+// stateNodeCounts from countStateNodes(), so that nodes that are
+// already busy with other work are treated as more loaded.
+func addBaselineStateNodeCounts(
+	stateNodeCounts map[string]map[string]float64,
+	opts PlanNextMapOptions,
+) {
+	for node, stateLoads := range opts.NodeStateBaselineLoads {
+		for stateName, load := range stateLoads {
+			adjustStateNodeCounts(stateNodeCounts, stateName,
+				[]string{node}, load)
+		}
+	}
+}
+
+// Returns the sum of the stateNodeCounts of each node, plus the
+// NodeBaselineLoads of the options, keyed by node.
+func countNodePartitions(
+	stateNodeCounts map[string]map[string]float64,
+	opts PlanNextMapOptions,
+) map[string]float64 {
+	rv := make(map[string]float64)
+	for _, nodeCounts := range stateNodeCounts {
+		for node, nodeCount := range nodeCounts {
+			rv[node] = rv[node] + nodeCount
+		}
+	}
+	for node, load := range opts.NodeBaselineLoads {
+		rv[node] = rv[node] + load
+	}
+	return rv
+}
+
+// Similar to countStateNodes(), but instead counts the amount of each
+// resource used per node.  Example, with input partitionMap of...
+//   { "0": { NodesByState: {"master": ["a"], "slave": ["b"]} } }
+// and partitionResources of {"0": {"disk": 10, "qps": 2}}, then
+// return value will be...
+//   { "master": { "disk": { "a": 10 }, "qps": { "a": 2 } },
+//     "slave": { "disk": { "b": 10 }, "qps": { "b": 2 } } }
+func countStateNodeResources(
+	partitionMap PartitionMap,
+	partitionResources map[string]map[string]int,
+) map[string]map[string]map[string]int {
+	rv := make(map[string]map[string]map[string]int)
+	for partitionName, partition := range partitionMap {
+		for stateName, nodes := range partition.NodesByState {
+			adjustStateNodeResources(rv, stateName, nodes,
+				partitionResources[partitionName], 1)
+		}
+	}
+	return rv
+}
+
+func adjustStateNodeResources(
+	stateResourceNodeCounts map[string]map[string]map[string]int,
+	stateName string, nodes []string,
+	resources map[string]int, // Keyed by resource name.
+	sign int) {
+	s, exists := stateResourceNodeCounts[stateName]
+	if !exists || s == nil {
+		s = make(map[string]map[string]int)
+		stateResourceNodeCounts[stateName] = s
+	}
+	for resource, amt := range resources {
+		r, exists := s[resource]
+		if !exists || r == nil {
+			r = make(map[string]int)
+			s[resource] = r
+		}
+		for _, node := range nodes {
+			r[node] = r[node] + sign*amt
+		}
+	}
+}
+
+// Returns the normalization factors used to compare the usage of
+// different resources.  The resourceUnits is keyed by resource name,
+// and is the average amount of the resource used by a partition, so
+// that a typical partition counts as about 1 unit, like an unweighted
+// partition.  The nodeResourceScales is keyed by node and then by
+// resource name, and is the node's amount of the resource relative to
+// the average of the nodes, where the default scale is 1.
+func calcResourceScales(
+	partitionMap PartitionMap,
+	nodes []string,
+	partitionResources map[string]map[string]int,
+	nodeResources map[string]map[string]int,
+) (resourceUnits map[string]float64,
+	nodeResourceScales map[string]map[string]float64) {
+	resourceUnits = make(map[string]float64)
+	if len(partitionMap) > 0 {
+		for partitionName := range partitionMap {
+			for resource, amt := range partitionResources[partitionName] {
+				resourceUnits[resource] =
+					resourceUnits[resource] + float64(amt)
+			}
+		}
+		for resource, amt := range resourceUnits {
+			resourceUnits[resource] = amt / float64(len(partitionMap))
+		}
+	}
+
+	nodeResourceScales = make(map[string]map[string]float64)
+	if nodeResources != nil {
+		resourceTotals := make(map[string]float64)
+		resourceNodes := make(map[string]int)
+		for _, node := range nodes {
+			for resource, amt := range nodeResources[node] {
+				resourceTotals[resource] =
+					resourceTotals[resource] + float64(amt)
+				resourceNodes[resource] = resourceNodes[resource] + 1
+			}
+		}
+		for _, node := range nodes {
+			for resource, amt := range nodeResources[node] {
+				avg := resourceTotals[resource] /
+					float64(resourceNodes[resource])
+				if avg > 0 {
+					m, exists := nodeResourceScales[node]
+					if !exists {
+						m = make(map[string]float64)
+						nodeResourceScales[node] = m
 					}
+					m[resource] = float64(amt) / avg
 				}
-				s[node] = s[node] + partitionWeight
 			}
 		}
 	}
+
+	return resourceUnits, nodeResourceScales
+}
+
+// Returns the constraints of a state from the model, unless it's
+// overridden by the ModelStateConstraints.
+func getStateConstraints(stateName string,
+	model PartitionModel, opts PlanNextMapOptions) int {
+	constraints := 0
+
+	modelState, exists := model[stateName]
+	if exists && modelState != nil {
+		constraints = modelState.Constraints
+	}
+	if opts.ModelStateConstraints != nil {
+		modelStateConstraints, exists := opts.ModelStateConstraints[stateName]
+		if exists {
+			constraints = modelStateConstraints
+		}
+	}
+
+	return constraints
+}
+
+// Returns a map keyed by partitionName, where the value is the other
+// partitions that share any of the anti-affinity groups with the
+// partition.
+func mapAntiAffinityPartitions(
+	antiAffinityGroups map[string][]string) map[string][]string {
+	groupNames := make([]string, 0, len(antiAffinityGroups))
+	for groupName := range antiAffinityGroups {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames) // Sort for stability.
+
+	rv := make(map[string][]string)
+	for _, groupName := range groupNames {
+		members := antiAffinityGroups[groupName]
+		for _, member := range members {
+			others := StringsRemoveStrings(members, []string{member})
+			rv[member] = append(rv[member],
+				StringsRemoveStrings(others, rv[member])...)
+		}
+	}
+	return rv
+}
+
+// The placement rules of a partition in a state, from the
+// PartitionPins and AntiAffinityGroups options.
+type placementRules struct {
+	// True when the partition is pinned to the pinnedNodes.
+	pinned      bool
+	pinnedNodes map[string]bool
+
+	// Nodes that have partitions from the same anti-affinity groups
+	// as the partition.
+	antiAffinityNodes map[string]bool
+}
+
+func newPlacementRules(partitionName, stateName string,
+	partitions PartitionMap, // The partitions as assigned so far.
+	antiAffinityPartitions map[string][]string,
+	opts PlanNextMapOptions) *placementRules {
+	pinnedNodes, pinned := opts.PartitionPins[partitionName][stateName]
+
+	antiAffinityNodes := map[string]bool{}
+	for _, other := range antiAffinityPartitions[partitionName] {
+		if p := partitions[other]; p != nil {
+			for _, node := range flattenNodesByState(p.NodesByState) {
+				antiAffinityNodes[node] = true
+			}
+		}
+	}
+
+	return &placementRules{
+		pinned:            pinned,
+		pinnedNodes:       StringsToMap(pinnedNodes),
+		antiAffinityNodes: antiAffinityNodes,
+	}
+}
+
+// Reorders the nodes so that nodes that meet the pins come first, and
+// then nodes that meet the anti-affinity groups, but otherwise keeps
+// the order of the nodes.  So, the rules are soft, and the planner
+// warns when a rule isn't met.
+func (r *placementRules) order(nodes []string) []string {
+	if !r.pinned && len(r.antiAffinityNodes) <= 0 {
+		return nodes
+	}
+	var ranks [4][]string
+	for _, node := range nodes {
+		rank := 0
+		if r.pinned && !r.pinnedNodes[node] {
+			rank = rank + 2
+		}
+		if r.antiAffinityNodes[node] {
+			rank = rank + 1
+		}
+		ranks[rank] = append(ranks[rank], node)
+	}
+	rv := make([]string, 0, len(nodes))
+	for _, rankNodes := range ranks {
+		rv = append(rv, rankNodes...)
+	}
+	return rv
+}
+
+// Filters the nodes to only the nodes that meet all the rules.
+func (r *placementRules) filter(nodes []string) []string {
+	if !r.pinned && len(r.antiAffinityNodes) <= 0 {
+		return nodes
+	}
+	rv := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if (!r.pinned || r.pinnedNodes[node]) &&
+			!r.antiAffinityNodes[node] {
+			rv = append(rv, node)
+		}
+	}
+	return rv
+}
+
+// Returns the warnings for the rules that aren't met by the nodes
+// that are assigned to the partition in the state.
+func (r *placementRules) warnings(partitionName, stateName string,
+	constraints int, nodes []string) []PlanWarning {
+	var warnings []PlanWarning
+
+	for _, node := range nodes {
+		if r.pinned && !r.pinnedNodes[node] {
+			warnings = append(warnings, PlanWarning{
+				Code:        WarningPinNotMet,
+				StateName:   stateName,
+				Partition:   partitionName,
+				Constraints: constraints,
+			})
+			break
+		}
+	}
+
+	for _, node := range nodes {
+		if r.antiAffinityNodes[node] {
+			warnings = append(warnings, PlanWarning{
+				Code:        WarningAntiAffinityNotMet,
+				StateName:   stateName,
+				Partition:   partitionName,
+				Constraints: constraints,
+			})
+			break
+		}
+	}
+
+	return warnings
+}
+
+// Returns the constraints of a partition in a given state, where the
+// PartitionStateConstraints takes precedence over the state's
+// constraints, and whether the partition had an override.
+func getPartitionConstraints(partitionName, stateName string,
+	stateConstraints int, opts PlanNextMapOptions) (int, bool) {
+	if opts.PartitionStateConstraints != nil {
+		c, exists := opts.PartitionStateConstraints[partitionName][stateName]
+		if exists {
+			return c, true
+		}
+	}
+	return stateConstraints, false
+}
+
+// Returns true if any partition overrides the constraints of the
+// given state.
+func hasPartitionConstraints(stateName string,
+	opts PlanNextMapOptions) bool {
+	for _, stateConstraints := range opts.PartitionStateConstraints {
+		if _, exists := stateConstraints[stateName]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the weight of a partition in a given state, where a
+// per-state weight from PartitionStateWeights takes precedence over
+// the partition's weight from PartitionWeightsFloat, and then from
+// PartitionWeights, and the default partition weight is 1.
+func getPartitionWeight(partitionName string, stateName string,
+	opts PlanNextMapOptions) float64 {
+	if opts.PartitionStateWeights != nil {
+		w, exists := opts.PartitionStateWeights[partitionName][stateName]
+		if exists {
+			return float64(w)
+		}
+	}
+	if opts.PartitionWeightsFloat != nil {
+		w, exists := opts.PartitionWeightsFloat[partitionName]
+		if exists {
+			return w
+		}
+	}
+	if opts.PartitionWeights != nil {
+		w, exists := opts.PartitionWeights[partitionName]
+		if exists {
+			return float64(w)
+		}
+	}
+	return 1
+}
+
+// Returns the union of the int weights and the float weights as
+// float64's, where the float weights take precedence, or nil if both
+// are nil.
+func mergeWeights(weights map[string]int,
+	weightsFloat map[string]float64) map[string]float64 {
+	if weights == nil && weightsFloat == nil {
+		return nil
+	}
+	rv := make(map[string]float64, len(weights)+len(weightsFloat))
+	for k, w := range weights {
+		rv[k] = float64(w)
+	}
+	for k, w := range weightsFloat {
+		rv[k] = w
+	}
+	return rv
+}
+
+// Returns the stickiness of a partition in a given state, which is
+// the per-partition stickiness override, or else the state's
+// stickiness, or else the default of 1.5, plus the move cost, which
+// is the MoveCostFactor proportional to the partition's weight.
+func getStickiness(partitionName, stateName string,
+	opts PlanNextMapOptions) float64 {
+	stickiness := 1.5
+	if opts.StateStickiness != nil {
+		s, exists := opts.StateStickiness[stateName]
+		if exists {
+			stickiness = float64(s)
+		}
+	}
+	if opts.StateStickinessFloat != nil {
+		s, exists := opts.StateStickinessFloat[stateName]
+		if exists {
+			stickiness = s
+		}
+	}
+	if opts.PartitionStickiness != nil {
+		s, exists := opts.PartitionStickiness[partitionName]
+		if exists {
+			stickiness = float64(s)
+		}
+	}
+	if opts.MoveCostFactor != 0 {
+		stickiness = stickiness + opts.MoveCostFactor*
+			getPartitionWeight(partitionName, stateName, opts)
+	}
+	return stickiness
+}
+
+// Returns a copy of the NodeCapacities, where the capacity of each
+// node in the NodeWarmUps is lowered to its fraction of the node's
+// fair share of the weighted partitions of the partitionMap, which
+// is the sum of the partition weights of every state, per the
+// constraints, divided among the nodesNext per their NodeWeights.
+func calcWarmUpCapacities(partitionMap PartitionMap, nodesNext []string,
+	model PartitionModel, opts PlanNextMapOptions) map[string]int {
+	rv := make(map[string]int, len(opts.NodeCapacities))
+	for node, c := range opts.NodeCapacities {
+		rv[node] = c
+	}
+
+	total := 0.0
+	for partitionName := range partitionMap {
+		for stateName := range model {
+			constraints, _ := getPartitionConstraints(partitionName,
+				stateName, getStateConstraints(stateName, model, opts), opts)
+			if constraints > 0 {
+				total = total + float64(constraints)*
+					getPartitionWeight(partitionName, stateName, opts)
+			}
+		}
+	}
+
+	nodeWeights := mergeWeights(opts.NodeWeights, opts.NodeWeightsFloat)
+
+	getNodeWeight := func(node string) float64 {
+		if w, exists := nodeWeights[node]; exists {
+			return math.Max(0, w)
+		}
+		return 1
+	}
+
+	sumNodeWeights := 0.0
+	for _, node := range nodesNext {
+		sumNodeWeights = sumNodeWeights + getNodeWeight(node)
+	}
+
+	for node, fraction := range opts.NodeWarmUps {
+		if fraction >= 1 || sumNodeWeights <= 0 {
+			continue
+		}
+		share := total * getNodeWeight(node) / sumNodeWeights
+		c := int(math.Ceil(math.Max(0, fraction) * share))
+		if prev, exists := rv[node]; !exists || c < prev {
+			rv[node] = c
+		}
+	}
+
+	return rv
+}
+
+// Returns the hard limit on the sum of the partition weights across
+// all states of a node, which is the lower of the node's
+// NodeCapacities and the MaxPartitions of its NodeDrains, if any.
+func getNodeCapacity(node string, opts PlanNextMapOptions) (int, bool) {
+	c, exists := opts.NodeCapacities[node]
+	if drain := opts.NodeDrains[node]; drain != nil &&
+		drain.MaxPartitions > 0 && (!exists || drain.MaxPartitions < c) {
+		return drain.MaxPartitions, true
+	}
+	return c, exists
+}
+
+// Returns true if the node may be assigned partitions in the given
+// state, which is false when the state isn't in the node's
+// NodeAllowedStates, or when the node's NodeDrains has the state.
+func nodeAllowsState(node, stateName string, opts PlanNextMapOptions) bool {
+	if allowedStates, exists := opts.NodeAllowedStates[node]; exists &&
+		len(StringsIntersectStrings(allowedStates, []string{stateName})) <= 0 {
+		return false
+	}
+	if drain := opts.NodeDrains[node]; drain != nil &&
+		len(StringsIntersectStrings(drain.States, []string{stateName})) > 0 {
+		return false
+	}
+	return true
+}
+
+// Returns true if the node has enough remaining capacity, per the
+// NodeCapacities, NodeStateCapacities and NodeDrains options, to be
+// assigned the partitions in the given state, where the partitions
+// are a partition and the other members of its affinity group, if
+// any.  The partitions' current assignments to the node are not
+// counted against the node, as they would be replaced by the new
+// assignment.
+func nodeHasCapacity(node string, partitions []*Partition, stateName string,
+	nodeStateCounts map[string]float64, // Keyed by node.
+	nodePartitionCounts map[string]float64, // Keyed by node.
+	opts PlanNextMapOptions) bool {
+	if opts.NodeCapacities != nil || opts.NodeDrains != nil {
+		c, exists := getNodeCapacity(node, opts)
+		if exists {
+			used := nodePartitionCounts[node]
+			for _, partition := range partitions {
+				for sName, nodes := range partition.NodesByState {
+					if len(StringsIntersectStrings(nodes, []string{node})) > 0 {
+						used = used -
+							getPartitionWeight(partition.Name, sName, opts)
+					}
+				}
+				used = used +
+					getPartitionWeight(partition.Name, stateName, opts)
+			}
+			if used > float64(c) {
+				return false
+			}
+		}
+	}
+
+	if opts.NodeStateCapacities != nil {
+		c, exists := opts.NodeStateCapacities[node][stateName]
+		if exists {
+			used := nodeStateCounts[node]
+			for _, partition := range partitions {
+				partitionWeight :=
+					getPartitionWeight(partition.Name, stateName, opts)
+				nodes := partition.NodesByState[stateName]
+				if len(StringsIntersectStrings(nodes, []string{node})) > 0 {
+					used = used - partitionWeight
+				}
+				used = used + partitionWeight
+			}
+			if used > float64(c) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Returns a map keyed by the partitionName of the leader of each
+// affinity group, where the value is the group's partitions, with the
+// leader first.  Only partitions that are in the partitions map are
+// included, and the leader is the group's first such partition.  A
+// partition is only in its first affinity group, ordered by group
+// name.
+func mapAffinityGroups(affinityGroups map[string][]string,
+	partitions map[string]*Partition) map[string][]*Partition {
+	groupNames := make([]string, 0, len(affinityGroups))
+	for groupName := range affinityGroups {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames) // Sort for stability.
+
+	seen := map[string]bool{}
+
+	rv := make(map[string][]*Partition)
+	for _, groupName := range groupNames {
+		var members []*Partition
+		for _, partitionName := range affinityGroups[groupName] {
+			partition := partitions[partitionName]
+			if partition != nil && !seen[partitionName] {
+				seen[partitionName] = true
+				members = append(members, partition)
+			}
+		}
+		if len(members) > 1 {
+			rv[members[0].Name] = members
+		}
+	}
 	return rv
 }
 
 // --------------------------------------------------------
 
+func planWarningStrings(planWarnings []PlanWarning) []string {
+	rv := make([]string, 0, len(planWarnings))
+	for _, w := range planWarnings {
+		rv = append(rv, w.String())
+	}
+	return rv
+}
+
+// Returns the moves for every partition that's different between the
+// prevMap and the nextMap, keyed by partitionName.
+func calcPlanMoves(prevMap, nextMap PartitionMap,
+	model PartitionModel, favorMinNodes bool) map[string][]NodeStateOp {
+	states := sortStateNames(model)
+
+	rv := make(map[string][]NodeStateOp)
+	for partitionName, partition := range nextMap {
+		var begNodesByState map[string][]string
+		if prevPartition := prevMap[partitionName]; prevPartition != nil {
+			begNodesByState = prevPartition.NodesByState
+		}
+		moves := CalcPartitionMoves(states,
+			begNodesByState, partition.NodesByState, favorMinNodes)
+		if len(moves) > 0 {
+			rv[partitionName] = moves
+		}
+	}
+
+	// Partitions that were removed are deleted from all their nodes.
+	for partitionName, prevPartition := range prevMap {
+		if _, exists := nextMap[partitionName]; !exists {
+			moves := CalcPartitionMoves(states,
+				prevPartition.NodesByState, nil, favorMinNodes)
+			if len(moves) > 0 {
+				rv[partitionName] = moves
+			}
+		}
+	}
+
+	return rv
+}
+
+// Returns a copy of the partition map, but with the partitionsToAdd
+// added with no assignments, if they're not already in the partition
+// map, and with the partitionsToRemove removed.
+func addRemovePartitions(m PartitionMap,
+	partitionsToAdd, partitionsToRemove []string) PartitionMap {
+	removeMap := StringsToMap(partitionsToRemove)
+
+	rv := PartitionMap{}
+	for partitionName, partition := range m {
+		if !removeMap[partitionName] {
+			rv[partitionName] = partition
+		}
+	}
+	for _, partitionName := range partitionsToAdd {
+		_, exists := rv[partitionName]
+		if !exists && !removeMap[partitionName] {
+			rv[partitionName] = &Partition{
+				Name:         partitionName,
+				NodesByState: map[string][]string{},
+			}
+		}
+	}
+	return rv
+}
+
+// Returns the weighted load of every node before and after a plan,
+// keyed by node.
+func calcNodeLoads(prevMap, nextMap PartitionMap,
+	nodesAll []string, opts PlanNextMapOptions) map[string]*NodeLoad {
+	rv := make(map[string]*NodeLoad)
+	for _, node := range nodesAll {
+		rv[node] = &NodeLoad{
+			BeforeByState: map[string]float64{},
+			AfterByState:  map[string]float64{},
+		}
+	}
+
+	for stateName, nodeCounts := range countStateNodes(prevMap, opts) {
+		for node, nodeCount := range nodeCounts {
+			if nodeLoad, exists := rv[node]; exists {
+				nodeLoad.Before = nodeLoad.Before + nodeCount
+				nodeLoad.BeforeByState[stateName] = nodeCount
+			}
+		}
+	}
+
+	for stateName, nodeCounts := range countStateNodes(nextMap, opts) {
+		for node, nodeCount := range nodeCounts {
+			if nodeLoad, exists := rv[node]; exists {
+				nodeLoad.After = nodeLoad.After + nodeCount
+				nodeLoad.AfterByState[stateName] = nodeCount
+			}
+		}
+	}
+
+	return rv
+}
+
 // Returns a copy of nodesByState but with nodes removed.  Example,
 // when removeNodes == ["a"] and nodesByState == {"master": ["a"],
 // "slave": ["b"]}, then result will be {"master": [], "slave":
@@ -433,8 +1270,8 @@ func (pms *stateNameSorter) Less(i, j int) bool {
 	if pms.m != nil &&
 		pms.m[iname] != nil &&
 		pms.m[jname] != nil &&
-		pms.m[iname].Priority < pms.m[jname].Priority {
-		return true
+		pms.m[iname].Priority != pms.m[jname].Priority {
+		return pms.m[iname].Priority < pms.m[jname].Priority
 	}
 
 	return iname < jname
@@ -448,13 +1285,19 @@ func (pms *stateNameSorter) Swap(i, j int) {
 
 // Does ORDER BY partitions-on-nodes-to-be-removed, then by
 // partitions-who-haven't-been-assigned-anywhere-yet, then by
-// partition-weight, then by partition-name.
+// partition-weight, then by partition-name, unless the
+// opts.PartitionOrderer overrides the ordering.
 type partitionSorter struct {
-	stateName        string // When "", just sort by partition name.
-	prevMap          PartitionMap
-	nodesToRemove    []string
-	nodesToAdd       []string
-	partitionWeights map[string]int // Keyed by partition name.
+	stateName     string // When "", just sort by partition name.
+	prevMap       PartitionMap
+	nodesToRemove []string
+	nodesToAdd    []string
+	opts          PlanNextMapOptions // For weights and orderer.
+
+	// Keyed by the partitionName of an affinity group's leader, value
+	// is the group's partitions, where the leader is weighted with the
+	// combined weight of the group.
+	affinityGroups map[string][]*Partition
 
 	a []*Partition // This array is mutated during sort.Sort().
 }
@@ -489,6 +1332,45 @@ func (r *partitionSorter) Swap(i, j int) {
 
 func (r *partitionSorter) Score(i int) []string {
 	partitionName := r.a[i].Name
+
+	var prevPartition *Partition
+	if r.prevMap != nil {
+		prevPartition = r.prevMap[partitionName]
+	}
+
+	weight := getPartitionWeight(partitionName, r.stateName, r.opts)
+	if members := r.affinityGroups[partitionName]; members != nil {
+		weight = 0
+		for _, member := range members {
+			weight = weight +
+				getPartitionWeight(member.Name, r.stateName, r.opts)
+		}
+	}
+
+	partitionOrder := PartitionOrder{
+		Partition:     r.a[i],
+		PrevPartition: prevPartition,
+		StateName:     r.stateName,
+		Weight:        weight,
+		NodesToRemove: r.nodesToRemove,
+		NodesToAdd:    r.nodesToAdd,
+	}
+
+	if r.opts.PartitionOrderer != nil && r.stateName != "" {
+		return r.opts.PartitionOrderer.OrderPartition(&partitionOrder)
+	}
+
+	return DefaultOrderPartition(&partitionOrder)
+}
+
+// DefaultOrderPartition is the planner's default PartitionOrderer,
+// which orders partitions on nodes that are to-be-removed first, then
+// partitions that haven't been assigned to any newly added nodes yet,
+// then heavier partitions, then by partition name.  Applications can
+// wrap it with PartitionOrdererFunc, such as by prepending their own
+// sort key.
+func DefaultOrderPartition(p *PartitionOrder) []string {
+	partitionName := p.Partition.Name
 	partitionNameStr := partitionName
 
 	// If the partitionName looks like a positive integer, then
@@ -498,33 +1380,27 @@ func (r *partitionSorter) Score(i int) []string {
 		partitionNameStr = fmt.Sprintf("%10d", partitionN)
 	}
 
-	// Calculate partition weight, and zero-pad it for sortability,
-	// where the nine 9's magic number is to to allow heavier
-	// partitions to come first.
-	partitionWeight := 1
-	if r.partitionWeights != nil {
-		if w, exists := r.partitionWeights[partitionName]; exists {
-			partitionWeight = w
-		}
-	}
-	partitionWeightStr := fmt.Sprintf("%10d", 999999999-partitionWeight)
+	// Zero-pad the partition weight for sortability, where the nine
+	// 9's magic number is to to allow heavier partitions to come
+	// first.
+	partitionWeightStr :=
+		fmt.Sprintf("%20.6f", 999999999.0-p.Weight)
 
 	// First, favor partitions on nodes that are to-be-removed.
-	if r.prevMap != nil &&
-		r.nodesToRemove != nil {
-		lastPartition := r.prevMap[partitionName]
-		lpnbs := lastPartition.NodesByState[r.stateName]
+	if p.PrevPartition != nil &&
+		p.NodesToRemove != nil {
+		lpnbs := p.PrevPartition.NodesByState[p.StateName]
 		if lpnbs != nil &&
-			len(StringsIntersectStrings(lpnbs, r.nodesToRemove)) > 0 {
+			len(StringsIntersectStrings(lpnbs, p.NodesToRemove)) > 0 {
 			return []string{"0", partitionWeightStr, partitionNameStr}
 		}
 	}
 
 	// Then, favor partitions who haven't yet been assigned to any
 	// newly added nodes yet for any state.
-	if r.nodesToAdd != nil {
-		fnbs := flattenNodesByState(r.a[i].NodesByState)
-		if len(StringsIntersectStrings(fnbs, r.nodesToAdd)) <= 0 {
+	if p.NodesToAdd != nil {
+		fnbs := flattenNodesByState(p.Partition.NodesByState)
+		if len(StringsIntersectStrings(fnbs, p.NodesToAdd)) <= 0 {
 			return []string{"1", partitionWeightStr, partitionNameStr}
 		}
 	}
@@ -539,14 +1415,23 @@ type nodeSorter struct {
 	partition           *Partition
 	numPartitions       int
 	topPriorityNode     string
-	stateNodeCounts     map[string]map[string]int
+	stateNodeCounts     map[string]map[string]float64
 	nodeToNodeCounts    map[string]map[string]int
-	nodePartitionCounts map[string]int
+	nodePartitionCounts map[string]float64
 	nodePositions       map[string]int
-	nodeWeights         map[string]int
+	nodeWeights         map[string]float64
 	stickiness          float64
+	nodeScorer          NodeScorer
 
 	a []string // Entries are node names.
+
+	// When nodeResourceCounts is non-nil, nodes are balanced by
+	// resource utilization instead of by stateNodeCounts.  The
+	// nodeResourceCounts is keyed by resource name, value is {node:
+	// amount} for the stateName.
+	nodeResourceCounts map[string]map[string]int
+	resourceUnits      map[string]float64
+	nodeResourceScales map[string]map[string]float64
 }
 
 func (ns *nodeSorter) Len() int {
@@ -572,52 +1457,118 @@ func (ns *nodeSorter) Swap(i, j int) {
 func (ns *nodeSorter) Score(i int) float64 {
 	node := ns.a[i]
 
-	lowerPriorityBalanceFactor := 0.0
-	if ns.nodeToNodeCounts != nil && ns.numPartitions > 0 {
+	lowerPriorityCount := 0
+	if ns.nodeToNodeCounts != nil {
 		m, exists := ns.nodeToNodeCounts[ns.topPriorityNode]
 		if exists {
-			lowerPriorityBalanceFactor =
-				float64(m[node]) / float64(ns.numPartitions)
+			lowerPriorityCount = m[node]
 		}
 	}
 
-	filledFactor := 0.0
-	if ns.nodePartitionCounts != nil && ns.numPartitions > 0 {
-		c, exists := ns.nodePartitionCounts[node]
-		if exists {
-			filledFactor = (0.001 * float64(c)) / float64(ns.numPartitions)
-		}
+	nodeLoad := 0.0
+	if ns.nodePartitionCounts != nil {
+		nodeLoad = ns.nodePartitionCounts[node]
 	}
 
-	currentFactor := 0.0
+	current := false
 	if ns.partition != nil {
 		for _, stateNode := range ns.partition.NodesByState[ns.stateName] {
 			if stateNode == node {
-				currentFactor = ns.stickiness
+				current = true
 			}
 		}
 	}
 
-	r := 0.0
-	if ns.stateNodeCounts != nil {
+	stateLoad := 0.0
+	if ns.nodeResourceCounts != nil {
+		stateLoad = ns.resourceUtilization(node)
+	} else if ns.stateNodeCounts != nil {
 		nodeCounts, exists := ns.stateNodeCounts[ns.stateName]
 		if exists && nodeCounts != nil {
-			r = float64(nodeCounts[node])
+			stateLoad = nodeCounts[node]
 		}
 	}
 
-	r = r + lowerPriorityBalanceFactor
-	r = r + filledFactor
-
+	nodeWeight := 1.0
 	if ns.nodeWeights != nil {
 		w, exists := ns.nodeWeights[node]
 		if exists && w > 0 {
-			r = r / float64(w)
+			nodeWeight = w
 		}
 	}
 
-	r = r - currentFactor
+	nodeScore := NodeScore{
+		Node:               node,
+		StateName:          ns.stateName,
+		Partition:          ns.partition,
+		NumPartitions:      ns.numPartitions,
+		TopPriorityNode:    ns.topPriorityNode,
+		StateLoad:          stateLoad,
+		NodeLoad:           nodeLoad,
+		LowerPriorityCount: lowerPriorityCount,
+		NodeWeight:         nodeWeight,
+		Current:            current,
+		Stickiness:         ns.stickiness,
+	}
+
+	if ns.nodeScorer != nil {
+		return ns.nodeScorer.ScoreNode(&nodeScore)
+	}
+
+	return DefaultScoreNode(&nodeScore)
+}
+
+// DefaultScoreNode is the planner's default NodeScorer heuristic,
+// which favors nodes with fewer partitions in the state being
+// assigned, while also spreading lower priority partitions (e.g.,
+// slaves) across nodes, favoring less filled nodes, scaling by node
+// weight, and favoring the nodes that the partition is already
+// assigned to, per the stickiness.  Applications can wrap it with
+// NodeScorerFunc to add their own factors.
+func DefaultScoreNode(s *NodeScore) float64 {
+	lowerPriorityBalanceFactor := 0.0
+	filledFactor := 0.0
+	if s.NumPartitions > 0 {
+		lowerPriorityBalanceFactor =
+			float64(s.LowerPriorityCount) / float64(s.NumPartitions)
+		filledFactor = (0.001 * s.NodeLoad) / float64(s.NumPartitions)
+	}
+
+	r := s.StateLoad
+	r = r + lowerPriorityBalanceFactor
+	r = r + filledFactor
 
+	if s.NodeWeight > 0 {
+		r = r / s.NodeWeight
+	}
+
+	if s.Current {
+		r = r - s.Stickiness
+	}
+
+	return r
+}
+
+// resourceUtilization returns the highest utilization of a node
+// across all the resource dimensions, where the usage of each
+// resource is normalized by the resourceUnits and by the node's
+// resource scale.
+func (ns *nodeSorter) resourceUtilization(node string) float64 {
+	r := 0.0
+	for resource, nodeCounts := range ns.nodeResourceCounts {
+		units := ns.resourceUnits[resource]
+		if units <= 0 {
+			continue
+		}
+		u := float64(nodeCounts[node]) / units
+		scale, exists := ns.nodeResourceScales[node][resource]
+		if exists && scale > 0 {
+			u = u / scale
+		}
+		if r < u {
+			r = u
+		}
+	}
 	return r
 }
 
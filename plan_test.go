@@ -169,11 +169,57 @@ func TestStateNameSorter(t *testing.T) {
 	}
 }
 
+func TestSortStateNames(t *testing.T) {
+	tests := []struct {
+		m   PartitionModel
+		exp []string
+	}{
+		{PartitionModel{}, []string{}},
+		{
+			PartitionModel{
+				"master": &PartitionModelState{Priority: 0},
+				"slave":  &PartitionModelState{Priority: 1},
+			},
+			[]string{"master", "slave"},
+		},
+		{ // A lower priority state name that sorts first by name.
+			PartitionModel{
+				"primary": &PartitionModelState{Priority: 0},
+				"backup":  &PartitionModelState{Priority: 1},
+			},
+			[]string{"primary", "backup"},
+		},
+		{
+			PartitionModel{
+				"primary": &PartitionModelState{Priority: 0},
+				"replica": &PartitionModelState{Priority: 1},
+				"backup":  &PartitionModelState{Priority: 2},
+			},
+			[]string{"primary", "replica", "backup"},
+		},
+		{ // Same priorities are ordered by name.
+			PartitionModel{
+				"primary": &PartitionModelState{Priority: 0},
+				"replica": &PartitionModelState{Priority: 1},
+				"backup":  &PartitionModelState{Priority: 1},
+			},
+			[]string{"primary", "backup", "replica"},
+		},
+	}
+	for i, c := range tests {
+		r := sortStateNames(c.m)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, m: %#v, exp: %#v, got: %#v",
+				i, c.m, c.exp, r)
+		}
+	}
+}
+
 func TestCountStateNodes(t *testing.T) {
 	tests := []struct {
 		m   PartitionMap
 		w   map[string]int
-		exp map[string]map[string]int
+		exp map[string]map[string]float64
 	}{
 		{
 			PartitionMap{
@@ -187,7 +233,7 @@ func TestCountStateNodes(t *testing.T) {
 				}},
 			},
 			nil,
-			map[string]map[string]int{
+			map[string]map[string]float64{
 				"master": {
 					"a": 1,
 					"b": 1,
@@ -209,7 +255,7 @@ func TestCountStateNodes(t *testing.T) {
 				}},
 			},
 			nil,
-			map[string]map[string]int{
+			map[string]map[string]float64{
 				"master": {
 					"b": 1,
 				},
@@ -221,7 +267,7 @@ func TestCountStateNodes(t *testing.T) {
 		},
 	}
 	for i, c := range tests {
-		r := countStateNodes(c.m, c.w)
+		r := countStateNodes(c.m, PlanNextMapOptions{PartitionWeights: c.w})
 		if !reflect.DeepEqual(r, c.exp) {
 			t.Errorf("i: %d, m: %#v, w: %#v, exp: %#v",
 				i, c.m, c.w, c.exp)
@@ -1517,6 +1563,8 @@ type VisTestCase struct {
 	NodeWeights           map[string]int
 	NodeHierarchy         map[string]string
 	HierarchyRules        HierarchyRules
+	PartitionStickiness   map[string]int
+	MoveCostFactor        float64
 	expNumWarnings        int
 }
 
@@ -1607,18 +1655,22 @@ func testVisTestCases(t *testing.T, tests []VisTestCase) {
 				}
 			}
 		}
-		r, rWarnings := PlanNextMap(
+		r, rWarnings := PlanNextMapEx(
 			prevMap,
 			c.Nodes,
 			c.NodesToRemove,
 			c.NodesToAdd,
 			c.Model,
-			c.ModelStateConstraints,
-			c.PartitionWeights,
-			c.StateStickiness,
-			c.NodeWeights,
-			c.NodeHierarchy,
-			c.HierarchyRules)
+			PlanNextMapOptions{
+				ModelStateConstraints: c.ModelStateConstraints,
+				PartitionWeights:      c.PartitionWeights,
+				StateStickiness:       c.StateStickiness,
+				NodeWeights:           c.NodeWeights,
+				NodeHierarchy:         c.NodeHierarchy,
+				HierarchyRules:        c.HierarchyRules,
+				PartitionStickiness:   c.PartitionStickiness,
+				MoveCostFactor:        c.MoveCostFactor,
+			})
 		if !reflect.DeepEqual(r, expMap) {
 			jc, _ := json.Marshal(c)
 			jp, _ := json.Marshal(prevMap)
@@ -1901,12 +1953,14 @@ func TestPlanNextMapVis(t *testing.T) {
 			expNumWarnings: 0,
 		},
 		{
+			// The MoveCostFactor keeps the heavy partition 000 in
+			// place, so other partitions move off of node b.
 			About: "8 partitions, 4 nodes, increase partition 000 weight",
 			FromTo: [][]string{
 				//        abcd    abcd
-				{"sm  ", " m s"},
-				{"  ms", "s m "},
-				{"s  m", "s  m"},
+				{"sm  ", "sm  "},
+				{"  ms", "  ms"},
+				{"s  m", "  sm"},
 				{" ms ", "  sm"},
 				{" sm ", " sm "},
 				{" s m", " s m"},
@@ -1917,6 +1971,7 @@ func TestPlanNextMapVis(t *testing.T) {
 			NodesToRemove:    []string{},
 			NodesToAdd:       []string{},
 			PartitionWeights: map[string]int{"000": 100},
+			MoveCostFactor:   1,
 			Model:            partitionModel1Master1Slave,
 			expNumWarnings:   0,
 		},
@@ -1937,6 +1992,7 @@ func TestPlanNextMapVis(t *testing.T) {
 			NodesToRemove:    []string{},
 			NodesToAdd:       []string{},
 			PartitionWeights: map[string]int{"004": 100},
+			MoveCostFactor:   1,
 			Model:            partitionModel1Master1Slave,
 			expNumWarnings:   0,
 		},
@@ -1944,11 +2000,11 @@ func TestPlanNextMapVis(t *testing.T) {
 			About: "8 partitions, 4 nodes, increase partition 000, 004 weight",
 			FromTo: [][]string{
 				//        abcd    abcd
-				{"sm  ", " m s"}, // partition 000.
+				{"sm  ", "sm  "}, // partition 000.
 				{"  ms", " s m"},
 				{"s  m", "  sm"},
 				{" ms ", "m s "},
-				{" sm ", "s m "}, // partition 004.
+				{" sm ", "  ms"}, // partition 004.
 				{" s m", " s m"},
 				{"ms  ", "ms  "},
 				{"m s ", "m s "},
@@ -1957,6 +2013,7 @@ func TestPlanNextMapVis(t *testing.T) {
 			NodesToRemove:    []string{},
 			NodesToAdd:       []string{},
 			PartitionWeights: map[string]int{"000": 100, "004": 100},
+			MoveCostFactor:   1,
 			Model:            partitionModel1Master1Slave,
 			expNumWarnings:   0,
 		},
@@ -2508,3 +2565,1666 @@ func Test2Slaves(t *testing.T) {
 	}
 	testVisTestCases(t, tests)
 }
+
+func TestPlanNextMapNodeCapacities(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{}},
+		"3": &Partition{Name: "3", NodesByState: map[string][]string{}},
+	}
+	tests := []struct {
+		About               string
+		NodeCapacities      map[string]int
+		NodeStateCapacities map[string]map[string]int
+		exp                 PartitionMap
+		expNumWarnings      int
+	}{
+		{
+			About:          "enough capacity",
+			NodeCapacities: map[string]int{"a": 4, "b": 4},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"3": &Partition{Name: "3", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+			},
+			expNumWarnings: 0,
+		},
+		{
+			About:          "not enough capacity for slaves",
+			NodeCapacities: map[string]int{"a": 3, "b": 3},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {}}},
+				"3": &Partition{Name: "3", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {}}},
+			},
+			expNumWarnings: 2,
+		},
+		{
+			About:          "small node",
+			NodeCapacities: map[string]int{"a": 1},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {}}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {}}},
+				"3": &Partition{Name: "3", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {}}},
+			},
+			expNumWarnings: 3,
+		},
+		{
+			About: "no masters allowed on node a",
+			NodeStateCapacities: map[string]map[string]int{
+				"a": {"master": 0},
+			},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"3": &Partition{Name: "3", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+			},
+			expNumWarnings: 0,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, []string{}, []string{"a", "b"},
+			partitionModel1Master1Slave, PlanNextMapOptions{
+				NodeCapacities:      c.NodeCapacities,
+				NodeStateCapacities: c.NodeStateCapacities,
+			})
+		if !reflect.DeepEqual(r, c.exp) {
+			jr, _ := json.Marshal(r)
+			jexp, _ := json.Marshal(c.exp)
+			t.Errorf("i: %d, about: %s,"+
+				" [RESULT] r: %s, [EXPECTED] exp: %s",
+				i, c.About, jr, jexp)
+		}
+		if c.expNumWarnings != len(rWarnings) {
+			t.Errorf("i: %d, about: %s, rWarnings: %v, expNumWarnings: %d",
+				i, c.About, rWarnings, c.expNumWarnings)
+		}
+	}
+}
+
+func TestCountStateNodeResources(t *testing.T) {
+	m := PartitionMap{
+		"0": &Partition{NodesByState: map[string][]string{
+			"master": {"a"},
+			"slave":  {"b", "c"},
+		}},
+		"1": &Partition{NodesByState: map[string][]string{
+			"master": {"b"},
+			"slave":  {"c"},
+		}},
+	}
+	r := countStateNodeResources(m, map[string]map[string]int{
+		"0": {"disk": 10, "qps": 1},
+		"1": {"disk": 1},
+	})
+	exp := map[string]map[string]map[string]int{
+		"master": {
+			"disk": {"a": 10, "b": 1},
+			"qps":  {"a": 1},
+		},
+		"slave": {
+			"disk": {"b": 10, "c": 11},
+			"qps":  {"b": 1, "c": 1},
+		},
+	}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %#v, got: %#v", exp, r)
+	}
+}
+
+func TestPlanNextMapResources(t *testing.T) {
+	partitionModel1Master0Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{}},
+		"3": &Partition{Name: "3", NodesByState: map[string][]string{}},
+	}
+	tests := []struct {
+		About              string
+		PartitionResources map[string]map[string]int
+		NodeResources      map[string]map[string]int
+		exp                map[string][]string // Keyed by node.
+	}{
+		{
+			About: "one big partition",
+			PartitionResources: map[string]map[string]int{
+				"0": {"disk": 10},
+				"1": {"disk": 1},
+				"2": {"disk": 1},
+				"3": {"disk": 1},
+			},
+			exp: map[string][]string{
+				"a": {"1", "2", "3"},
+				"b": {"0"},
+			},
+		},
+		{
+			About: "two resource dimensions",
+			PartitionResources: map[string]map[string]int{
+				"0": {"disk": 10, "memory": 1},
+				"1": {"disk": 10, "memory": 1},
+				"2": {"disk": 1, "memory": 10},
+				"3": {"disk": 1, "memory": 10},
+			},
+			exp: map[string][]string{
+				"a": {"0", "2"},
+				"b": {"1", "3"},
+			},
+		},
+		{
+			About: "node with more disk",
+			PartitionResources: map[string]map[string]int{
+				"0": {"disk": 10},
+				"1": {"disk": 10},
+				"2": {"disk": 10},
+				"3": {"disk": 10},
+			},
+			NodeResources: map[string]map[string]int{
+				"a": {"disk": 300},
+				"b": {"disk": 100},
+			},
+			exp: map[string][]string{
+				"a": {"0", "2", "3"},
+				"b": {"1"},
+			},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, []string{}, []string{"a", "b"},
+			partitionModel1Master0Slave, PlanNextMapOptions{
+				PartitionResources: c.PartitionResources,
+				NodeResources:      c.NodeResources,
+			})
+		got := map[string][]string{}
+		for _, partitionName := range []string{"0", "1", "2", "3"} {
+			for _, node := range r[partitionName].NodesByState["master"] {
+				got[node] = append(got[node], partitionName)
+			}
+		}
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %#v, got: %#v",
+				i, c.About, c.exp, got)
+		}
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, rWarnings: %v",
+				i, c.About, rWarnings)
+		}
+	}
+}
+
+func TestCountStateNodesStateWeights(t *testing.T) {
+	m := PartitionMap{
+		"0": &Partition{NodesByState: map[string][]string{
+			"master": {"a"},
+			"slave":  {"b", "c"},
+		}},
+		"1": &Partition{NodesByState: map[string][]string{
+			"master": {"b"},
+			"slave":  {"c"},
+		}},
+	}
+	r := countStateNodes(m, PlanNextMapOptions{
+		PartitionWeights: map[string]int{"0": 2, "1": 2},
+		PartitionStateWeights: map[string]map[string]int{
+			"0": {"master": 10},
+			"1": {"slave": 5},
+		},
+	})
+	exp := map[string]map[string]float64{
+		"master": {"a": 10, "b": 2},
+		"slave":  {"b": 2, "c": 7},
+	}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %#v, got: %#v", exp, r)
+	}
+}
+
+func TestPlanNextMapPartitionStateWeights(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{}},
+		"3": &Partition{Name: "3", NodesByState: map[string][]string{}},
+	}
+	tests := []struct {
+		About                 string
+		PartitionStateWeights map[string]map[string]int
+		exp                   PartitionMap
+		expNumWarnings        int
+	}{
+		{
+			About: "same weight for masters and slaves",
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"3": &Partition{Name: "3", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+			},
+			expNumWarnings: 0,
+		},
+		{
+			About: "heavier masters use up node a's capacity",
+			PartitionStateWeights: map[string]map[string]int{
+				"0": {"master": 3},
+				"1": {"master": 3},
+				"2": {"master": 3},
+				"3": {"master": 3},
+			},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"master": {"a"}, "slave": {"b"}}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {"a"}}},
+				"3": &Partition{Name: "3", NodesByState: map[string][]string{
+					"master": {"b"}, "slave": {}}},
+			},
+			expNumWarnings: 1,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, []string{}, []string{"a", "b"},
+			partitionModel1Master1Slave, PlanNextMapOptions{
+				NodeCapacities:        map[string]int{"a": 5},
+				PartitionStateWeights: c.PartitionStateWeights,
+			})
+		if !reflect.DeepEqual(r, c.exp) {
+			jr, _ := json.Marshal(r)
+			jexp, _ := json.Marshal(c.exp)
+			t.Errorf("i: %d, about: %s,"+
+				" [RESULT] r: %s, [EXPECTED] exp: %s",
+				i, c.About, jr, jexp)
+		}
+		if c.expNumWarnings != len(rWarnings) {
+			t.Errorf("i: %d, about: %s, rWarnings: %v, expNumWarnings: %d",
+				i, c.About, rWarnings, c.expNumWarnings)
+		}
+	}
+}
+
+func TestPlanNextMapStickiness(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	tests := []VisTestCase{
+		{
+			About: "default stickiness rebalances",
+			FromTo: [][]string{
+				{"ms", "sm"},
+				{"ms", "ms"},
+			},
+			Nodes:          []string{"a", "b"},
+			NodesToRemove:  []string{},
+			NodesToAdd:     []string{},
+			Model:          partitionModel1Master1Slave,
+			expNumWarnings: 0,
+		},
+		{
+			About: "state stickiness is used without partition weights",
+			FromTo: [][]string{
+				{"ms", "ms"},
+				{"ms", "ms"},
+			},
+			Nodes:           []string{"a", "b"},
+			NodesToRemove:   []string{},
+			NodesToAdd:      []string{},
+			Model:           partitionModel1Master1Slave,
+			StateStickiness: map[string]int{"master": 5},
+			expNumWarnings:  0,
+		},
+		{
+			About: "partition weight does not override state stickiness",
+			FromTo: [][]string{
+				{"ms", "ms"},
+				{"ms", "ms"},
+			},
+			Nodes:            []string{"a", "b"},
+			NodesToRemove:    []string{},
+			NodesToAdd:       []string{},
+			Model:            partitionModel1Master1Slave,
+			PartitionWeights: map[string]int{"000": 1, "001": 1},
+			StateStickiness:  map[string]int{"master": 5},
+			expNumWarnings:   0,
+		},
+		{
+			About: "partition stickiness overrides state stickiness",
+			FromTo: [][]string{
+				{"ms", "sm"},
+				{"ms", "ms"},
+			},
+			Nodes:               []string{"a", "b"},
+			NodesToRemove:       []string{},
+			NodesToAdd:          []string{},
+			Model:               partitionModel1Master1Slave,
+			StateStickiness:     map[string]int{"master": 5},
+			PartitionStickiness: map[string]int{"000": 1},
+			expNumWarnings:      0,
+		},
+		{
+			About: "move cost proportional to partition weight",
+			FromTo: [][]string{
+				{"ms", "ms"},
+				{"ms", "sm"},
+			},
+			Nodes:            []string{"a", "b"},
+			NodesToRemove:    []string{},
+			NodesToAdd:       []string{},
+			Model:            partitionModel1Master1Slave,
+			PartitionWeights: map[string]int{"000": 5},
+			MoveCostFactor:   1,
+			expNumWarnings:   0,
+		},
+	}
+	testVisTestCases(t, tests)
+}
+
+func TestPlanNextMapFloatWeights(t *testing.T) {
+	partitionModel1Master0Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 10; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About   string
+		Options PlanNextMapOptions
+		exp     map[string]int // Keyed by node, value is # of masters.
+	}{
+		{
+			About:   "default node weights",
+			Options: PlanNextMapOptions{},
+			exp:     map[string]int{"a": 5, "b": 5},
+		},
+		{
+			About: "float node weight",
+			Options: PlanNextMapOptions{
+				NodeWeightsFloat: map[string]float64{"a": 1.5},
+			},
+			exp: map[string]int{"a": 6, "b": 4},
+		},
+		{
+			About: "float node weight takes precedence",
+			Options: PlanNextMapOptions{
+				NodeWeights:      map[string]int{"a": 4},
+				NodeWeightsFloat: map[string]float64{"a": 1.5},
+			},
+			exp: map[string]int{"a": 6, "b": 4},
+		},
+		{
+			About: "float partition weight",
+			Options: PlanNextMapOptions{
+				PartitionWeightsFloat: map[string]float64{"00": 2.5},
+			},
+			exp: map[string]int{"a": 4, "b": 6},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, []string{}, []string{"a", "b"},
+			partitionModel1Master0Slave, c.Options)
+		got := map[string]int{}
+		for _, partition := range r {
+			for _, node := range partition.NodesByState["master"] {
+				got[node]++
+			}
+		}
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %#v, got: %#v",
+				i, c.About, c.exp, got)
+		}
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, rWarnings: %v",
+				i, c.About, rWarnings)
+		}
+	}
+}
+
+func TestGetStickinessFloat(t *testing.T) {
+	tests := []struct {
+		opts PlanNextMapOptions
+		exp  float64
+	}{
+		{PlanNextMapOptions{}, 1.5},
+		{PlanNextMapOptions{
+			StateStickiness: map[string]int{"master": 2},
+		}, 2},
+		{PlanNextMapOptions{
+			StateStickinessFloat: map[string]float64{"master": 0.75},
+		}, 0.75},
+		{PlanNextMapOptions{
+			StateStickiness:      map[string]int{"master": 2},
+			StateStickinessFloat: map[string]float64{"master": 0.75},
+		}, 0.75},
+		{PlanNextMapOptions{
+			StateStickinessFloat:  map[string]float64{"master": 0.75},
+			PartitionWeightsFloat: map[string]float64{"0": 0.5},
+			MoveCostFactor:        0.5,
+		}, 1},
+	}
+	for i, c := range tests {
+		r := getStickiness("0", "master", c.opts)
+		if r != c.exp {
+			t.Errorf("i: %d, exp: %v, got: %v", i, c.exp, r)
+		}
+	}
+}
+
+func TestDefaultScoreNode(t *testing.T) {
+	tests := []struct {
+		s   NodeScore
+		exp float64
+	}{
+		{NodeScore{}, 0},
+		{NodeScore{StateLoad: 2}, 2},
+		{NodeScore{StateLoad: 2, NodeWeight: 2}, 1},
+		{NodeScore{StateLoad: 2, NodeWeight: 2,
+			Current: true, Stickiness: 1.5}, -0.5},
+		{NodeScore{StateLoad: 2, NodeWeight: 1,
+			Current: false, Stickiness: 1.5}, 2},
+		{NodeScore{StateLoad: 2, NodeWeight: 1,
+			NumPartitions: 4, LowerPriorityCount: 2}, 2.5},
+		{NodeScore{StateLoad: 2, NodeWeight: 1,
+			NumPartitions: 4, NodeLoad: 4}, 2.001},
+	}
+	for i, c := range tests {
+		r := DefaultScoreNode(&c.s)
+		if r != c.exp {
+			t.Errorf("i: %d, s: %#v, exp: %v, got: %v", i, c.s, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapNodeScorer(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 6; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	unhealthy := map[string]float64{"a": 1000}
+	tests := []struct {
+		About      string
+		NodeScorer NodeScorer
+		exp        map[string]map[string]int // Keyed by state, node.
+	}{
+		{
+			About: "default scorer",
+			exp: map[string]map[string]int{
+				"master": {"a": 2, "b": 2, "c": 2},
+				"slave":  {"a": 2, "b": 2, "c": 2},
+			},
+		},
+		{
+			About: "wrapped scorer avoids unhealthy node",
+			NodeScorer: NodeScorerFunc(func(s *NodeScore) float64 {
+				return DefaultScoreNode(s) + unhealthy[s.Node]
+			}),
+			exp: map[string]map[string]int{
+				"master": {"b": 3, "c": 3},
+				"slave":  {"b": 3, "c": 3},
+			},
+		},
+		{
+			About: "replaced scorer packs masters onto the last node",
+			NodeScorer: NodeScorerFunc(func(s *NodeScore) float64 {
+				if s.StateName == "master" && s.Node == "c" {
+					return -1
+				}
+				return s.StateLoad
+			}),
+			exp: map[string]map[string]int{
+				"master": {"c": 6},
+				"slave":  {"a": 3, "b": 3},
+			},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b", "c"}, []string{}, []string{"a", "b", "c"},
+			partitionModel1Master1Slave, PlanNextMapOptions{
+				NodeScorer: c.NodeScorer,
+			})
+		got := map[string]map[string]int{}
+		for _, partition := range r {
+			for stateName, nodes := range partition.NodesByState {
+				for _, node := range nodes {
+					if got[stateName] == nil {
+						got[stateName] = map[string]int{}
+					}
+					got[stateName][node]++
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %#v, got: %#v",
+				i, c.About, c.exp, got)
+		}
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, rWarnings: %v",
+				i, c.About, rWarnings)
+		}
+	}
+}
+
+func TestDefaultOrderPartition(t *testing.T) {
+	tests := []struct {
+		About         string
+		Partition     *Partition
+		PrevPartition *Partition
+		Weight        float64
+		NodesToRemove []string
+		NodesToAdd    []string
+		exp           []string
+	}{
+		{
+			About: "plain",
+			Partition: &Partition{Name: "x",
+				NodesByState: map[string][]string{}},
+			Weight: 1,
+			exp:    []string{"2", "    999999998.000000", "x"},
+		},
+		{
+			About: "integer name is padded, heavier weight",
+			Partition: &Partition{Name: "12",
+				NodesByState: map[string][]string{}},
+			Weight: 9,
+			exp:    []string{"2", "    999999990.000000", "        12"},
+		},
+		{
+			About: "on a node to be removed",
+			Partition: &Partition{Name: "x",
+				NodesByState: map[string][]string{}},
+			PrevPartition: &Partition{Name: "x",
+				NodesByState: map[string][]string{"master": {"a"}}},
+			Weight:        1,
+			NodesToRemove: []string{"a"},
+			exp:           []string{"0", "    999999998.000000", "x"},
+		},
+		{
+			About: "not yet on an added node",
+			Partition: &Partition{Name: "x",
+				NodesByState: map[string][]string{"master": {"a"}}},
+			Weight:     1,
+			NodesToAdd: []string{"b"},
+			exp:        []string{"1", "    999999998.000000", "x"},
+		},
+		{
+			About: "already on an added node",
+			Partition: &Partition{Name: "x",
+				NodesByState: map[string][]string{"slave": {"b"}}},
+			Weight:     1,
+			NodesToAdd: []string{"b"},
+			exp:        []string{"2", "    999999998.000000", "x"},
+		},
+	}
+	for i, c := range tests {
+		got := DefaultOrderPartition(&PartitionOrder{
+			Partition:     c.Partition,
+			PrevPartition: c.PrevPartition,
+			StateName:     "master",
+			Weight:        c.Weight,
+			NodesToRemove: c.NodesToRemove,
+			NodesToAdd:    c.NodesToAdd,
+		})
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %#v, got: %#v",
+				i, c.About, c.exp, got)
+		}
+	}
+}
+
+func TestPlanNextMapPartitionOrderer(t *testing.T) {
+	partitionModel1Master := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	critical := map[string]bool{"02": true}
+	tests := []struct {
+		About            string
+		PartitionOrderer PartitionOrderer
+		expUnassigned    string
+	}{
+		{
+			About:         "default orderer",
+			expUnassigned: "02",
+		},
+		{
+			About: "critical partitions first",
+			PartitionOrderer: PartitionOrdererFunc(func(p *PartitionOrder) []string {
+				k := "1"
+				if critical[p.Partition.Name] {
+					k = "0"
+				}
+				return append([]string{k}, DefaultOrderPartition(p)...)
+			}),
+			expUnassigned: "01",
+		},
+	}
+	for i, c := range tests {
+		prevMap := PartitionMap{}
+		for j := 0; j < 3; j++ {
+			partitionName := fmt.Sprintf("%02d", j)
+			prevMap[partitionName] = &Partition{
+				Name:         partitionName,
+				NodesByState: map[string][]string{},
+			}
+		}
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, []string{}, []string{"a", "b"},
+			partitionModel1Master, PlanNextMapOptions{
+				NodeCapacities:   map[string]int{"a": 1, "b": 1},
+				PartitionOrderer: c.PartitionOrderer,
+			})
+		var unassigned []string
+		for _, partition := range r {
+			if len(partition.NodesByState["master"]) <= 0 {
+				unassigned = append(unassigned, partition.Name)
+			}
+		}
+		if !reflect.DeepEqual(unassigned, []string{c.expUnassigned}) {
+			t.Errorf("i: %d, about: %s, expUnassigned: %s, got: %v, r: %v",
+				i, c.About, c.expUnassigned, unassigned, r)
+		}
+		if len(rWarnings) != 1 {
+			t.Errorf("i: %d, about: %s, rWarnings: %v",
+				i, c.About, rWarnings)
+		}
+	}
+}
+
+func TestPlanNextMapStats(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	emptyMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		emptyMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	nodes := []string{"a", "b", "c"}
+	stableMap, _ := PlanNextMapEx(emptyMap,
+		nodes, []string{}, nodes, partitionModel1Master1Slave,
+		PlanNextMapOptions{})
+
+	tests := []struct {
+		About         string
+		prevMap       PartitionMap
+		nodesToAdd    []string
+		MaxIterations int
+		expStats      PlanStats
+	}{
+		{
+			About:      "new nodes, default max iterations",
+			prevMap:    emptyMap,
+			nodesToAdd: nodes,
+			expStats:   PlanStats{Iterations: 2, Converged: true},
+		},
+		{
+			About:         "new nodes, too few iterations",
+			prevMap:       emptyMap,
+			nodesToAdd:    nodes,
+			MaxIterations: 1,
+			expStats:      PlanStats{Iterations: 1, Converged: false},
+		},
+		{
+			About:         "already stable",
+			prevMap:       stableMap,
+			nodesToAdd:    []string{},
+			MaxIterations: 1,
+			expStats:      PlanStats{Iterations: 1, Converged: true},
+		},
+	}
+	for i, c := range tests {
+		r, _, stats := PlanNextMapStats(c.prevMap,
+			nodes, []string{}, c.nodesToAdd,
+			partitionModel1Master1Slave, PlanNextMapOptions{
+				MaxIterations: c.MaxIterations,
+			})
+		if stats != c.expStats {
+			t.Errorf("i: %d, about: %s, expStats: %#v, got: %#v",
+				i, c.About, c.expStats, stats)
+		}
+		if len(r) != len(emptyMap) {
+			t.Errorf("i: %d, about: %s, r: %v", i, c.About, r)
+		}
+	}
+}
+
+func TestPlanNextMapV2(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"00": &Partition{Name: "00",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "slave": {"b"}}},
+		"01": &Partition{Name: "01",
+			NodesByState: map[string][]string{
+				"master": {"b"}, "slave": {"a"}}},
+	}
+
+	r := PlanNextMapV2(prevMap,
+		[]string{"a", "b"}, []string{"b"}, []string{},
+		partitionModel1Master1Slave, PlanNextMapOptions{})
+
+	expNextMap := PartitionMap{
+		"00": &Partition{Name: "00",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "slave": {}}},
+		"01": &Partition{Name: "01",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "slave": {}}},
+	}
+	if !reflect.DeepEqual(r.NextMap, expNextMap) {
+		t.Errorf("expNextMap: %v, got: %v", expNextMap, r.NextMap)
+	}
+
+	expWarnings := []PlanWarning{
+		{WarningConstraintsNotMet, "slave", "00", 1},
+		{WarningConstraintsNotMet, "slave", "01", 1},
+	}
+	if !reflect.DeepEqual(r.Warnings, expWarnings) {
+		t.Errorf("expWarnings: %v, got: %v", expWarnings, r.Warnings)
+	}
+
+	if r.Iterations != 2 || !r.Converged {
+		t.Errorf("expected convergence, got: %#v", r.PlanStats)
+	}
+
+	expNodeLoads := map[string]*NodeLoad{
+		"a": {
+			Before:        2,
+			After:         2,
+			BeforeByState: map[string]float64{"master": 1, "slave": 1},
+			AfterByState:  map[string]float64{"master": 2},
+		},
+		"b": {
+			Before:        2,
+			After:         0,
+			BeforeByState: map[string]float64{"master": 1, "slave": 1},
+			AfterByState:  map[string]float64{},
+		},
+	}
+	if !reflect.DeepEqual(r.NodeLoads, expNodeLoads) {
+		t.Errorf("expNodeLoads: %v, got: %v", expNodeLoads, r.NodeLoads)
+	}
+
+	expMoves := map[string][]NodeStateOp{
+		"00": {
+			{"b", "", "del"},
+		},
+		"01": {
+			{"a", "master", "promote"},
+			{"b", "", "del"},
+		},
+	}
+	if !reflect.DeepEqual(r.Moves, expMoves) {
+		t.Errorf("expMoves: %v, got: %v", expMoves, r.Moves)
+	}
+
+	if r.PlanDuration < 0 || r.TotalDuration < r.PlanDuration {
+		t.Errorf("bad durations, plan: %v, total: %v",
+			r.PlanDuration, r.TotalDuration)
+	}
+}
+
+func TestPlanWarningString(t *testing.T) {
+	tests := []struct {
+		w   PlanWarning
+		exp string
+	}{
+		{PlanWarning{WarningConstraintsNotMet, "slave", "00", 2},
+			"could not meet constraints: 2, stateName: slave, partitionName: 00"},
+		{PlanWarning{WarningInsufficientCapacity, "master", "01", 1},
+			"could not meet constraints: 1, stateName: master, partitionName: 01," +
+				" due to insufficient node capacity"},
+		{PlanWarning{WarningStateNotAllowed, "master", "02", 1},
+			"could not meet constraints: 1, stateName: master, partitionName: 02," +
+				" due to nodes that are not allowed the state"},
+	}
+	for i, c := range tests {
+		if c.w.String() != c.exp {
+			t.Errorf("i: %d, exp: %s, got: %s", i, c.exp, c.w.String())
+		}
+	}
+}
+
+func TestPlanNextMapAddRemovePartitions(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"00": &Partition{Name: "00",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "slave": {"b"}}},
+		"01": &Partition{Name: "01",
+			NodesByState: map[string][]string{
+				"master": {"b"}, "slave": {"a"}}},
+	}
+
+	r := PlanNextMapV2(prevMap,
+		[]string{"a", "b"}, []string{}, []string{},
+		partitionModel1Master1Slave, PlanNextMapOptions{
+			PartitionsToAdd:    []string{"02"},
+			PartitionsToRemove: []string{"01"},
+		})
+
+	expNextMap := PartitionMap{
+		"00": &Partition{Name: "00",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "slave": {"b"}}},
+		"02": &Partition{Name: "02",
+			NodesByState: map[string][]string{
+				"master": {"b"}, "slave": {"a"}}},
+	}
+	if !reflect.DeepEqual(r.NextMap, expNextMap) {
+		t.Errorf("expNextMap: %v, got: %v", expNextMap, r.NextMap)
+	}
+	if len(r.Warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", r.Warnings)
+	}
+
+	expMoves := map[string][]NodeStateOp{
+		"01": {
+			{"b", "", "del"},
+			{"a", "", "del"},
+		},
+		"02": {
+			{"b", "master", "add"},
+			{"a", "slave", "add"},
+		},
+	}
+	if !reflect.DeepEqual(r.Moves, expMoves) {
+		t.Errorf("expMoves: %v, got: %v", expMoves, r.Moves)
+	}
+
+	if len(prevMap) != 2 || prevMap["01"] == nil {
+		t.Errorf("expected prevMap to be unchanged, got: %v", prevMap)
+	}
+}
+
+func TestPlanNextMapPartitionStateConstraints(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+		"standby": &PartitionModelState{
+			Priority: 2, Constraints: 0,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d", "e"}
+	prevMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	partitionStateConstraints := map[string]map[string]int{
+		"00": {"slave": 3},
+		"01": {"slave": 0},
+		"02": {"standby": 1},
+	}
+	expCounts := func(partitionName string) map[string]int {
+		switch partitionName {
+		case "00":
+			return map[string]int{"master": 1, "slave": 3}
+		case "01":
+			return map[string]int{"master": 1, "slave": 0}
+		case "02":
+			return map[string]int{"master": 1, "slave": 1, "standby": 1}
+		}
+		return map[string]int{"master": 1, "slave": 1}
+	}
+
+	for i, incremental := range []bool{false, true} {
+		r, warnings := PlanNextMapEx(prevMap,
+			nodes, []string{}, nodes, model, PlanNextMapOptions{
+				PartitionStateConstraints: partitionStateConstraints,
+				IncrementalConstraints:    incremental,
+				IncrementalMaxImbalance:   -1,
+			})
+		if len(warnings) != 0 {
+			t.Errorf("i: %d, expected no warnings, got: %v", i, warnings)
+		}
+		for partitionName, partition := range r {
+			got := map[string]int{}
+			for stateName, nodes := range partition.NodesByState {
+				if len(nodes) > 0 || stateName != "standby" {
+					got[stateName] = len(nodes)
+				}
+			}
+			exp := expCounts(partitionName)
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("i: %d, partition: %s, exp: %v, got: %v",
+					i, partitionName, exp, partition.NodesByState)
+			}
+			if len(flattenNodesByState(partition.NodesByState)) !=
+				len(StringsIntersectStrings(
+					flattenNodesByState(partition.NodesByState),
+					flattenNodesByState(partition.NodesByState))) {
+				t.Errorf("i: %d, partition: %s, duplicate nodes: %v",
+					i, partitionName, partition.NodesByState)
+			}
+		}
+	}
+}
+
+func TestPlanNextMapPinsAntiAffinity(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	partitionModel1Master := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	tests := []struct {
+		About              string
+		model              PartitionModel
+		PartitionPins      map[string]map[string][]string
+		AntiAffinityGroups map[string][]string
+		check              func(r PartitionMap) bool
+		expWarnings        []PlanWarning
+	}{
+		{
+			About: "pins",
+			model: partitionModel1Master1Slave,
+			PartitionPins: map[string]map[string][]string{
+				"00": {"master": {"d"}},
+				"01": {"master": {"c", "d"}, "slave": {"a"}},
+			},
+			check: func(r PartitionMap) bool {
+				return reflect.DeepEqual(r["00"].NodesByState["master"],
+					[]string{"d"}) &&
+					len(StringsIntersectStrings(r["01"].NodesByState["master"],
+						[]string{"c", "d"})) == 1 &&
+					reflect.DeepEqual(r["01"].NodesByState["slave"],
+						[]string{"a"})
+			},
+		},
+		{
+			About: "pins that can't be met",
+			model: partitionModel1Master1Slave,
+			PartitionPins: map[string]map[string][]string{
+				"00": {"master": {"a"}, "slave": {"a"}},
+			},
+			check: func(r PartitionMap) bool {
+				return reflect.DeepEqual(r["00"].NodesByState["master"],
+					[]string{"a"}) &&
+					len(r["00"].NodesByState["slave"]) == 1
+			},
+			expWarnings: []PlanWarning{
+				{WarningPinNotMet, "slave", "00", 1},
+			},
+		},
+		{
+			About: "anti-affinity for large partitions",
+			model: partitionModel1Master1Slave,
+			AntiAffinityGroups: map[string][]string{
+				"big": {"00", "01"},
+			},
+			check: func(r PartitionMap) bool {
+				return len(StringsIntersectStrings(
+					flattenNodesByState(r["00"].NodesByState),
+					flattenNodesByState(r["01"].NodesByState))) == 0
+			},
+		},
+		{
+			About: "anti-affinity for a tenant",
+			model: partitionModel1Master,
+			AntiAffinityGroups: map[string][]string{
+				"tenant": {"00", "02", "04", "06"},
+			},
+			check: func(r PartitionMap) bool {
+				return len(StringsIntersectStrings(
+					flattenNodesByState(map[string][]string{
+						"00": r["00"].NodesByState["master"],
+						"02": r["02"].NodesByState["master"],
+						"04": r["04"].NodesByState["master"],
+						"06": r["06"].NodesByState["master"],
+					}), []string{"a", "b", "c", "d"})) == 4
+			},
+		},
+		{
+			About: "anti-affinity that can't be met",
+			model: partitionModel1Master,
+			AntiAffinityGroups: map[string][]string{
+				"tenant": {"00", "01", "02", "03", "04"},
+			},
+			check: func(r PartitionMap) bool {
+				return true
+			},
+			// Both of the partitions that share a node are warned.
+			expWarnings: []PlanWarning{
+				{WarningAntiAffinityNotMet, "master", "00", 1},
+				{WarningAntiAffinityNotMet, "master", "04", 1},
+			},
+		},
+	}
+	for i, c := range tests {
+		prevMap := PartitionMap{}
+		for j := 0; j < 8; j++ {
+			partitionName := fmt.Sprintf("%02d", j)
+			prevMap[partitionName] = &Partition{
+				Name:         partitionName,
+				NodesByState: map[string][]string{},
+			}
+		}
+		nodes := []string{"a", "b", "c", "d"}
+		r := PlanNextMapV2(prevMap, nodes, []string{}, nodes,
+			c.model, PlanNextMapOptions{
+				PartitionPins:      c.PartitionPins,
+				AntiAffinityGroups: c.AntiAffinityGroups,
+			})
+		if !c.check(r.NextMap) {
+			t.Errorf("i: %d, about: %s, bad next map: %v",
+				i, c.About, r.NextMap)
+		}
+		if c.expWarnings == nil {
+			c.expWarnings = []PlanWarning{}
+		}
+		if !reflect.DeepEqual(r.Warnings, c.expWarnings) {
+			t.Errorf("i: %d, about: %s, expWarnings: %v, got: %v",
+				i, c.About, c.expWarnings, r.Warnings)
+		}
+	}
+}
+
+func TestPlanNextMapAffinityGroups(t *testing.T) {
+	partitionModel1Master1Slave := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+	prevMap := PartitionMap{}
+	affinityGroups := map[string][]string{}
+	for i := 0; i < 4; i++ {
+		for _, index := range []string{"x", "y"} {
+			partitionName := fmt.Sprintf("%s%d", index, i)
+			prevMap[partitionName] = &Partition{
+				Name:         partitionName,
+				NodesByState: map[string][]string{},
+			}
+		}
+		affinityGroups[fmt.Sprintf("g%d", i)] =
+			[]string{fmt.Sprintf("x%d", i), fmt.Sprintf("y%d", i)}
+	}
+
+	checkColocated := func(about string, r PartitionMap) {
+		for i := 0; i < 4; i++ {
+			x := r[fmt.Sprintf("x%d", i)].NodesByState
+			y := r[fmt.Sprintf("y%d", i)].NodesByState
+			if !reflect.DeepEqual(x, y) {
+				t.Errorf("%s: i: %d, expected co-located, x: %v, y: %v",
+					about, i, x, y)
+			}
+		}
+	}
+
+	opts := PlanNextMapOptions{
+		AffinityGroups: affinityGroups,
+	}
+	r, warnings := PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, partitionModel1Master1Slave, opts)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	checkColocated("plan", r)
+	exp := map[string]map[string]float64{
+		"master": {"a": 2, "b": 2, "c": 2, "d": 2},
+		"slave":  {"a": 2, "b": 2, "c": 2, "d": 2},
+	}
+	if got := countStateNodes(r, opts); !reflect.DeepEqual(got, exp) {
+		t.Errorf("plan, exp: %v, got: %v", exp, got)
+	}
+
+	r1 := r
+
+	// A node capacity that fits one partition but not a group.
+	opts.NodeCapacities = map[string]int{"d": 1}
+	r, warnings = PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, partitionModel1Master1Slave, opts)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	checkColocated("capacity", r)
+	if got := countStateNodes(r, opts); got["master"]["d"] != 0 ||
+		got["slave"]["d"] != 0 {
+		t.Errorf("capacity, expected nothing on d, got: %v", got)
+	}
+	opts.NodeCapacities = nil
+
+	// Raising the slaves incrementally keeps the groups co-located.
+	opts.ModelStateConstraints = map[string]int{"slave": 2}
+	opts.IncrementalConstraints = true
+	r2, warnings := PlanNextMapEx(r1,
+		nodes, []string{}, []string{}, partitionModel1Master1Slave, opts)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	checkColocated("incremental", r2)
+	exp = map[string]map[string]float64{
+		"master": {"a": 2, "b": 2, "c": 2, "d": 2},
+		"slave":  {"a": 4, "b": 4, "c": 4, "d": 4},
+	}
+	if got := countStateNodes(r2, opts); !reflect.DeepEqual(got, exp) {
+		t.Errorf("incremental, exp: %v, got: %v", exp, got)
+	}
+
+	// The local search leaves the groups alone.
+	opts.ModelStateConstraints = nil
+	opts.IncrementalConstraints = false
+	opts.LocalSearch = &LocalSearchOptions{}
+	r, _ = PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, partitionModel1Master1Slave, opts)
+	checkColocated("local search", r)
+}
+
+func TestPartitionSorterAffinityGroupWeight(t *testing.T) {
+	partitions := []*Partition{
+		{Name: "x", NodesByState: map[string][]string{}},
+		{Name: "y", NodesByState: map[string][]string{}},
+		{Name: "z", NodesByState: map[string][]string{}},
+	}
+	opts := PlanNextMapOptions{
+		PartitionWeights: map[string]int{"x": 2, "y": 3, "z": 4},
+	}
+	p := &partitionSorter{
+		stateName: "master",
+		opts:      opts,
+		affinityGroups: mapAffinityGroups(
+			map[string][]string{"g": {"x", "y"}},
+			map[string]*Partition{"x": partitions[0], "y": partitions[1]}),
+		a: partitions,
+	}
+
+	// The group's leader, x, is heavier than z with the combined
+	// weight of 5, so it comes first.
+	sort.Sort(p)
+	got := []string{p.a[0].Name, p.a[1].Name, p.a[2].Name}
+	if exp := []string{"x", "z", "y"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp: %v, got: %v", exp, got)
+	}
+}
+
+func TestPlanNextMapBaselineLoads(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b"}
+	prevMap := PartitionMap{}
+	for i := 0; i < 4; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+
+	tests := []struct {
+		about string
+		opts  PlanNextMapOptions
+		exp   map[string]float64
+	}{
+		{
+			about: "no baseline loads",
+			opts:  PlanNextMapOptions{},
+			exp:   map[string]float64{"a": 2, "b": 2},
+		},
+		{
+			about: "node state baseline load",
+			opts: PlanNextMapOptions{
+				NodeStateBaselineLoads: map[string]map[string]float64{
+					"a": {"master": 2},
+				},
+			},
+			exp: map[string]float64{"a": 1, "b": 3},
+		},
+		{
+			about: "node state baseline load of another state",
+			opts: PlanNextMapOptions{
+				NodeStateBaselineLoads: map[string]map[string]float64{
+					"a": {"slave": 2},
+				},
+			},
+			exp: map[string]float64{"a": 2, "b": 2},
+		},
+		{
+			about: "node baseline load counts against capacity",
+			opts: PlanNextMapOptions{
+				NodeBaselineLoads: map[string]float64{"a": 3},
+				NodeCapacities:    map[string]int{"a": 4},
+			},
+			exp: map[string]float64{"a": 1, "b": 3},
+		},
+		{
+			about: "node state baseline load counts against capacity",
+			opts: PlanNextMapOptions{
+				NodeStateBaselineLoads: map[string]map[string]float64{
+					"b": {"master": 3},
+				},
+				NodeStateCapacities: map[string]map[string]int{
+					"b": {"master": 3},
+				},
+			},
+			exp: map[string]float64{"a": 4},
+		},
+	}
+
+	for i, test := range tests {
+		r, warnings := PlanNextMapEx(prevMap,
+			nodes, []string{}, nodes, model, test.opts)
+		if len(warnings) != 0 {
+			t.Errorf("i: %d, about: %s, expected no warnings, got: %v",
+				i, test.about, warnings)
+		}
+		got := countStateNodes(r, PlanNextMapOptions{})["master"]
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, test.about, test.exp, got)
+		}
+	}
+}
+
+func TestPlanNextMapNodeDrains(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+	prevMap := testPlanPrevMap(t, nodes, model, 1)
+
+	tests := []struct {
+		about     string
+		drain     *NodeDrain
+		expMaster float64
+		minSlave  float64
+		maxSlave  float64
+	}{
+		{
+			about:     "drain masters",
+			drain:     &NodeDrain{States: []string{"master"}},
+			expMaster: 0,
+			minSlave:  1,
+			maxSlave:  8,
+		},
+		{
+			about:     "drain to max partitions",
+			drain:     &NodeDrain{MaxPartitions: 2},
+			expMaster: -1,
+			minSlave:  0,
+			maxSlave:  2,
+		},
+		{
+			about:     "drain all states",
+			drain:     &NodeDrain{States: []string{"master", "slave"}},
+			expMaster: 0,
+			minSlave:  0,
+			maxSlave:  0,
+		},
+	}
+
+	modes := []string{"full", "incremental", "local search"}
+
+	for i, test := range tests {
+		for _, mode := range modes {
+			opts := PlanNextMapOptions{
+				NodeDrains: map[string]*NodeDrain{"a": test.drain},
+			}
+			if mode == "incremental" {
+				opts.IncrementalConstraints = true
+				opts.IncrementalMaxImbalance = -1
+			}
+			if mode == "local search" {
+				opts.LocalSearch = &LocalSearchOptions{}
+			}
+
+			r, warnings := PlanNextMapEx(prevMap,
+				nodes, []string{}, []string{}, model, opts)
+			if len(warnings) != 0 {
+				t.Errorf("i: %d, about: %s, mode: %s,"+
+					" expected no warnings, got: %v",
+					i, test.about, mode, warnings)
+			}
+
+			counts := countStateNodes(r, PlanNextMapOptions{})
+			for _, stateName := range []string{"master", "slave"} {
+				total := 0.0
+				for _, count := range counts[stateName] {
+					total = total + count
+				}
+				if total != 8 {
+					t.Errorf("i: %d, about: %s, mode: %s,"+
+						" expected 8 %s, got: %v",
+						i, test.about, mode, stateName, counts)
+				}
+			}
+
+			masters := counts["master"]["a"]
+			slaves := counts["slave"]["a"]
+			if (test.expMaster >= 0 && masters != test.expMaster) ||
+				slaves < test.minSlave || slaves > test.maxSlave ||
+				(test.drain.MaxPartitions > 0 &&
+					masters+slaves > float64(test.drain.MaxPartitions)) {
+				t.Errorf("i: %d, about: %s, mode: %s,"+
+					" unexpected counts on drained node, got: %v",
+					i, test.about, mode, counts)
+			}
+		}
+	}
+
+	// A node that drains its masters keeps its slaves in place.
+	r, _ := PlanNextMapEx(prevMap,
+		nodes, []string{}, []string{}, model, PlanNextMapOptions{
+			NodeDrains: map[string]*NodeDrain{
+				"a": {States: []string{"master"}},
+			},
+			IncrementalConstraints:  true,
+			IncrementalMaxImbalance: -1,
+		})
+	for partitionName, partition := range prevMap {
+		if len(StringsIntersectStrings(partition.NodesByState["slave"],
+			[]string{"a"})) > 0 &&
+			!reflect.DeepEqual(r[partitionName].NodesByState["slave"],
+				partition.NodesByState["slave"]) {
+			t.Errorf("partition: %s, expected slave to stay, prev: %v, got: %v",
+				partitionName, partition.NodesByState,
+				r[partitionName].NodesByState)
+		}
+	}
+}
+
+func TestPlanNextMapNodeAllowedStates(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	tests := []struct {
+		About             string
+		NodeAllowedStates map[string][]string
+		expWarnings       []PlanWarning
+	}{
+		{
+			About: "read-only and master-only nodes",
+			NodeAllowedStates: map[string][]string{
+				"a": {"slave"},
+				"b": {"master"},
+			},
+		},
+		{
+			About: "no nodes allowed to be master",
+			NodeAllowedStates: map[string][]string{
+				"a": {"slave"},
+				"b": {"slave"},
+				"c": {"slave"},
+			},
+			expWarnings: []PlanWarning{
+				{WarningStateNotAllowed, "master", "00", 1},
+				{WarningStateNotAllowed, "master", "01", 1},
+				{WarningStateNotAllowed, "master", "02", 1},
+				{WarningStateNotAllowed, "master", "03", 1},
+			},
+		},
+	}
+	for i, c := range tests {
+		if c.expWarnings == nil {
+			c.expWarnings = []PlanWarning{}
+		}
+		for _, incremental := range []bool{false, true} {
+			prevMap := PartitionMap{}
+			for j := 0; j < 4; j++ {
+				partitionName := fmt.Sprintf("%02d", j)
+				prevMap[partitionName] = &Partition{
+					Name:         partitionName,
+					NodesByState: map[string][]string{},
+				}
+			}
+			nodes := []string{"a", "b", "c"}
+			r := PlanNextMapV2(prevMap, nodes, []string{}, nodes,
+				model, PlanNextMapOptions{
+					NodeAllowedStates:       c.NodeAllowedStates,
+					IncrementalConstraints:  incremental,
+					IncrementalMaxImbalance: -1,
+				})
+			for partitionName, partition := range r.NextMap {
+				for stateName, nodes := range partition.NodesByState {
+					for _, node := range nodes {
+						if !nodeAllowsState(node, stateName,
+							PlanNextMapOptions{
+								NodeAllowedStates: c.NodeAllowedStates,
+							}) {
+							t.Errorf("i: %d, about: %s, incremental: %v,"+
+								" partition: %s, disallowed state: %v",
+								i, c.About, incremental, partitionName,
+								partition.NodesByState)
+						}
+					}
+				}
+				if len(partition.NodesByState["slave"]) != 1 {
+					t.Errorf("i: %d, about: %s, incremental: %v,"+
+						" partition: %s, expected a slave, got: %v",
+						i, c.About, incremental, partitionName,
+						partition.NodesByState)
+				}
+			}
+			if !reflect.DeepEqual(r.Warnings, c.expWarnings) {
+				t.Errorf("i: %d, about: %s, incremental: %v,"+
+					" expWarnings: %v, got: %v",
+					i, c.About, incremental, c.expWarnings, r.Warnings)
+			}
+		}
+	}
+}
+
+func TestPlanNextMapNodeWarmUps(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := testPlanPrevMap(t, []string{"a", "b", "c"}, model, 1)
+
+	// The fair share of "d" is 4 of the 16 weighted partitions.
+	nodes := []string{"a", "b", "c", "d"}
+	nodesToAdd := []string{"d"}
+	for i, step := range []struct {
+		fraction float64
+		exp      float64
+	}{
+		{0.25, 1},
+		{0.5, 2},
+		{1, 4},
+	} {
+		nextMap, warnings := PlanNextMapEx(prevMap,
+			nodes, []string{}, nodesToAdd, model, PlanNextMapOptions{
+				NodeWarmUps: map[string]float64{"d": step.fraction},
+			})
+		if len(warnings) != 0 {
+			t.Errorf("i: %d, expected no warnings, got: %v", i, warnings)
+		}
+		got := countNodePartitions(
+			countStateNodes(nextMap, PlanNextMapOptions{}),
+			PlanNextMapOptions{})["d"]
+		if got != step.exp {
+			t.Errorf("i: %d, fraction: %f, exp: %f, got: %f",
+				i, step.fraction, step.exp, got)
+		}
+		prevMap = nextMap
+		nodesToAdd = []string{}
+	}
+}
+
+func TestCalcWarmUpCapacities(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	partitionMap := PartitionMap{
+		"00": &Partition{Name: "00"},
+		"01": &Partition{Name: "01"},
+		"02": &Partition{Name: "02"},
+		"03": &Partition{Name: "03"},
+	}
+	nodes := []string{"a", "b", "c"}
+
+	tests := []struct {
+		about string
+		opts  PlanNextMapOptions
+		exp   map[string]int
+	}{
+		{
+			about: "equal node weights",
+			opts: PlanNextMapOptions{
+				NodeWarmUps: map[string]float64{"a": 0.5, "b": 1},
+			},
+			exp: map[string]int{"a": 2},
+		},
+		{
+			about: "node weights and partition weights",
+			opts: PlanNextMapOptions{
+				NodeWeights:      map[string]int{"a": 2},
+				PartitionWeights: map[string]int{"00": 5},
+				NodeWarmUps:      map[string]float64{"a": 0.5},
+			},
+			exp: map[string]int{"a": 6},
+		},
+		{
+			about: "lower node capacities are kept",
+			opts: PlanNextMapOptions{
+				NodeCapacities: map[string]int{"a": 1, "b": 9},
+				NodeWarmUps:    map[string]float64{"a": 0.5, "b": 0},
+			},
+			exp: map[string]int{"a": 1, "b": 0},
+		},
+	}
+
+	for i, test := range tests {
+		got := calcWarmUpCapacities(partitionMap, nodes, model, test.opts)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, test.about, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"sort"
+)
+
+// A promoteDemoteSwap swaps the node at position i of a partition's
+// top priority state with the node at position j of the partition's
+// lower priority stateName.
+type promoteDemoteSwap struct {
+	partition *Partition
+	stateName string
+	i, j      int
+}
+
+// Plans the next map for the PromoteDemoteOnly option, by only
+// swapping the roles of the nodes that already hold copies of each
+// partition, first to move the top priority state off of the
+// nodesToRemove, and then to greedily balance the top priority state
+// across the nodes, until no swap improves the balance.  Warns about
+// the partitions that are left with fewer nodes in the top priority
+// state than its constraints, not counting the nodesToRemove or the
+// nodes with weights <= 0, such as when a partition has no replica
+// to promote, or is a new partition from the PartitionsToAdd.
+func planPromoteDemote(
+	prevMap PartitionMap,
+	nodesAll []string, // Union of nodesBefore, nodesToAdd, nodesToRemove.
+	nodesToRemove []string,
+	model PartitionModel,
+	opts PlanNextMapOptions,
+) (PartitionMap, []PlanWarning) {
+	warnings := []PlanWarning{}
+
+	nextMap := copyPartitionMap(prevMap)
+
+	stateNames := sortStateNames(model)
+	if len(stateNames) <= 0 {
+		return nextMap, warnings
+	}
+	topStateName := stateNames[0]
+
+	nodesNext := StringsToMap(StringsRemoveStrings(nodesAll, nodesToRemove))
+
+	nodeWeights := mergeWeights(opts.NodeWeights, opts.NodeWeightsFloat)
+
+	getNodeWeight := func(node string) float64 {
+		if w, exists := nodeWeights[node]; exists {
+			return w
+		}
+		return 1
+	}
+
+	// Keyed by node, value is the weighted count of the top priority
+	// state's partitions on the node.
+	nodeCounts := countStateNodes(nextMap, opts)[topStateName]
+	if nodeCounts == nil {
+		nodeCounts = map[string]float64{}
+	}
+
+	// The weighted counts of every state and of all the partitions of
+	// each node, including the baseline loads, so that the swaps keep
+	// the nodes within their capacities.
+	stateNodeCounts := countStateNodes(nextMap, opts)
+	addBaselineStateNodeCounts(stateNodeCounts, opts)
+	nodePartitionCounts := countNodePartitions(stateNodeCounts, opts)
+
+	partitionNames := make([]string, 0, len(nextMap))
+	for partitionName := range nextMap {
+		partitionNames = append(partitionNames, partitionName)
+	}
+	sort.Strings(partitionNames)
+
+	// Returns true if the swap keeps the nodes in states that they
+	// are allowed and within their capacities, and only promotes a
+	// node that remains in the cluster and that's not already in the
+	// top priority state.
+	canSwap := func(s promoteDemoteSwap) bool {
+		topNodes := s.partition.NodesByState[topStateName]
+		node := topNodes[s.i]
+		replica := s.partition.NodesByState[s.stateName][s.j]
+		return replica != node &&
+			nodesNext[replica] && getNodeWeight(replica) > 0 &&
+			len(StringsIntersectStrings(topNodes, []string{replica})) <= 0 &&
+			nodeAllowsState(replica, topStateName, opts) &&
+			nodeAllowsState(node, s.stateName, opts) &&
+			nodeHasCapacity(replica, []*Partition{s.partition}, topStateName,
+				stateNodeCounts[topStateName], nodePartitionCounts, opts) &&
+			nodeHasCapacity(node, []*Partition{s.partition}, s.stateName,
+				stateNodeCounts[s.stateName], nodePartitionCounts, opts)
+	}
+
+	// Returns the possible swaps of the top priority state's node at
+	// position i of a partition.
+	swapsOf := func(partition *Partition, i int) []promoteDemoteSwap {
+		var rv []promoteDemoteSwap
+		for _, stateName := range stateNames[1:] {
+			for j := range partition.NodesByState[stateName] {
+				s := promoteDemoteSwap{partition, stateName, i, j}
+				if canSwap(s) {
+					rv = append(rv, s)
+				}
+			}
+		}
+		return rv
+	}
+
+	// Returns the change in the sum of the squares of the weighted node
+	// loads, where a negative delta is a better balance.
+	deltaOf := func(s promoteDemoteSwap) float64 {
+		node := s.partition.NodesByState[topStateName][s.i]
+		replica := s.partition.NodesByState[s.stateName][s.j]
+		w := getPartitionWeight(s.partition.Name, topStateName, opts)
+		cost := func(node string, load float64) float64 {
+			if nodeWeight := getNodeWeight(node); nodeWeight > 0 {
+				return load * load / nodeWeight
+			}
+			return 0
+		}
+		return cost(replica, nodeCounts[replica]+w) -
+			cost(replica, nodeCounts[replica]) +
+			cost(node, nodeCounts[node]-w) -
+			cost(node, nodeCounts[node])
+	}
+
+	apply := func(s promoteDemoteSwap) {
+		topNodes := s.partition.NodesByState[topStateName]
+		stateNodes := s.partition.NodesByState[s.stateName]
+		node, replica := topNodes[s.i], stateNodes[s.j]
+		w := getPartitionWeight(s.partition.Name, topStateName, opts)
+		wState := getPartitionWeight(s.partition.Name, s.stateName, opts)
+		nodeCounts[node] = nodeCounts[node] - w
+		nodeCounts[replica] = nodeCounts[replica] + w
+		adjustStateNodeCounts(stateNodeCounts, topStateName,
+			[]string{node}, -w)
+		adjustStateNodeCounts(stateNodeCounts, s.stateName,
+			[]string{node}, wState)
+		adjustStateNodeCounts(stateNodeCounts, s.stateName,
+			[]string{replica}, -wState)
+		adjustStateNodeCounts(stateNodeCounts, topStateName,
+			[]string{replica}, w)
+		nodePartitionCounts[node] = nodePartitionCounts[node] - w + wState
+		nodePartitionCounts[replica] = nodePartitionCounts[replica] - wState + w
+		topNodes[s.i], stateNodes[s.j] = replica, node
+	}
+
+	// Move the top priority state off of the nodesToRemove, or off of
+	// nodes with weights <= 0, to the least loaded replicas.
+	for _, partitionName := range partitionNames {
+		partition := nextMap[partitionName]
+		for i, node := range partition.NodesByState[topStateName] {
+			if nodesNext[node] && getNodeWeight(node) > 0 {
+				continue
+			}
+			swaps := swapsOf(partition, i)
+			if len(swaps) <= 0 {
+				continue
+			}
+			best := swaps[0]
+			for _, s := range swaps[1:] {
+				if deltaOf(s) < deltaOf(best) {
+					best = s
+				}
+			}
+			apply(best)
+		}
+	}
+
+	// Greedily apply the swap that best improves the balance, where
+	// every applied swap strictly lowers the sum of the squares of the
+	// node loads, so the loop ends.
+	for {
+		var best *promoteDemoteSwap
+		bestDelta := -0.000001
+
+		for _, partitionName := range partitionNames {
+			partition := nextMap[partitionName]
+			for i, node := range partition.NodesByState[topStateName] {
+				if !nodesNext[node] || getNodeWeight(node) <= 0 {
+					continue
+				}
+				for _, s := range swapsOf(partition, i) {
+					if delta := deltaOf(s); delta < bestDelta {
+						s := s
+						best, bestDelta = &s, delta
+					}
+				}
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		apply(*best)
+	}
+
+	stateConstraints := getStateConstraints(topStateName, model, opts)
+
+	for _, partitionName := range partitionNames {
+		constraints, _ := getPartitionConstraints(partitionName,
+			topStateName, stateConstraints, opts)
+
+		n := 0
+		for _, node := range nextMap[partitionName].NodesByState[topStateName] {
+			if nodesNext[node] && getNodeWeight(node) > 0 {
+				n++
+			}
+		}
+
+		if n < constraints {
+			warnings = append(warnings, PlanWarning{
+				Code:        WarningConstraintsNotMet,
+				StateName:   topStateName,
+				Partition:   partitionName,
+				Constraints: constraints,
+			})
+		}
+	}
+
+	return nextMap, warnings
+}
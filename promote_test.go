@@ -0,0 +1,241 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanNextMapPromoteDemoteOnly(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+
+	// Fail over the masters of node "d" to their slaves.
+	prevMap := testPlanPrevMap(t, nodes, model, 1)
+	for _, partition := range prevMap {
+		if partition.NodesByState["master"][0] == "d" {
+			partition.NodesByState["master"], partition.NodesByState["slave"] =
+				partition.NodesByState["slave"], partition.NodesByState["master"]
+		}
+	}
+
+	tests := []struct {
+		about         string
+		nodesToRemove []string
+		opts          PlanNextMapOptions
+		exp           map[string]float64
+	}{
+		{
+			about: "restore master balance",
+			exp:   map[string]float64{"a": 2, "b": 2, "c": 2, "d": 2},
+		},
+		{
+			about: "node weights",
+			opts: PlanNextMapOptions{
+				NodeWeights: map[string]int{"a": 0},
+			},
+			exp: map[string]float64{"b": 3, "c": 3, "d": 2},
+		},
+		{
+			about:         "move masters off of a node to remove",
+			nodesToRemove: []string{"b"},
+			exp:           map[string]float64{"a": 3, "c": 3, "d": 2},
+		},
+		{
+			about: "node allowed states",
+			opts: PlanNextMapOptions{
+				NodeAllowedStates: map[string][]string{"d": {"slave"}},
+			},
+			exp: map[string]float64{"a": 2, "b": 3, "c": 3},
+		},
+	}
+
+	for i, test := range tests {
+		opts := test.opts
+		opts.PromoteDemoteOnly = true
+
+		r := PlanNextMapV2(prevMap, nodes, test.nodesToRemove, []string{},
+			model, opts)
+		if len(r.Warnings) != 0 {
+			t.Errorf("i: %d, about: %s, expected no warnings, got: %v",
+				i, test.about, r.Warnings)
+		}
+
+		got := map[string]float64{}
+		for node, count := range countStateNodes(r.NextMap,
+			PlanNextMapOptions{})["master"] {
+			if count > 0 {
+				got[node] = count
+			}
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, test.about, test.exp, got)
+		}
+
+		for partitionName, moves := range r.Moves {
+			for _, move := range moves {
+				if move.Op != "promote" && move.Op != "demote" {
+					t.Errorf("i: %d, about: %s, partition: %s,"+
+						" unexpected move: %v",
+						i, test.about, partitionName, move)
+				}
+			}
+		}
+	}
+}
+
+func TestPlanNextMapPromoteDemoteOnlyWarnings(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"master": {"a"}}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"master": {"a"}, "slave": {"b"}}},
+	}
+
+	r := PlanNextMapV2(prevMap, []string{"a", "b"}, []string{"a"},
+		[]string{}, model, PlanNextMapOptions{
+			PromoteDemoteOnly: true,
+			PartitionsToAdd:   []string{"2"},
+		})
+
+	exp := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"master": {"a"}}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"master": {"b"}, "slave": {"a"}}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{}},
+	}
+	if !reflect.DeepEqual(r.NextMap, exp) {
+		t.Errorf("exp: %v, got: %v", exp, r.NextMap)
+	}
+
+	expWarnings := []PlanWarning{
+		{
+			Code: WarningConstraintsNotMet, StateName: "master",
+			Partition: "0", Constraints: 1,
+		},
+		{
+			Code: WarningConstraintsNotMet, StateName: "master",
+			Partition: "2", Constraints: 1,
+		},
+	}
+	if !reflect.DeepEqual(r.Warnings, expWarnings) {
+		t.Errorf("exp warnings: %v, got: %v", expWarnings, r.Warnings)
+	}
+}
+
+func TestPlanNextMapPromoteDemoteOnlyCapacities(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"master": {"a"}, "slave": {"b"}}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"master": {"a"}, "slave": {"b"}}},
+	}
+	heavyMasters := map[string]map[string]int{
+		"0": {"master": 2}, "1": {"master": 2},
+	}
+
+	tests := []struct {
+		about string
+		opts  PlanNextMapOptions
+		exp   map[string]float64
+	}{
+		{
+			about: "no capacities",
+			exp:   map[string]float64{"a": 1, "b": 1},
+		},
+		{
+			about: "node state capacities",
+			opts: PlanNextMapOptions{
+				NodeStateCapacities: map[string]map[string]int{
+					"b": {"master": 0},
+				},
+			},
+			exp: map[string]float64{"a": 2},
+		},
+		{
+			about: "node capacities with heavier masters",
+			opts: PlanNextMapOptions{
+				NodeCapacities:        map[string]int{"b": 2},
+				PartitionStateWeights: heavyMasters,
+			},
+			exp: map[string]float64{"a": 2},
+		},
+		{
+			about: "node drain max partitions with heavier masters",
+			opts: PlanNextMapOptions{
+				NodeDrains: map[string]*NodeDrain{
+					"b": {MaxPartitions: 2},
+				},
+				PartitionStateWeights: heavyMasters,
+			},
+			exp: map[string]float64{"a": 2},
+		},
+		{
+			about: "node capacities with room for a heavier master",
+			opts: PlanNextMapOptions{
+				NodeCapacities:        map[string]int{"b": 3},
+				PartitionStateWeights: heavyMasters,
+			},
+			exp: map[string]float64{"a": 1, "b": 1},
+		},
+	}
+
+	for i, test := range tests {
+		opts := test.opts
+		opts.PromoteDemoteOnly = true
+
+		r := PlanNextMapV2(prevMap, []string{"a", "b"}, []string{},
+			[]string{}, model, opts)
+		if len(r.Warnings) != 0 {
+			t.Errorf("i: %d, about: %s, expected no warnings, got: %v",
+				i, test.about, r.Warnings)
+		}
+
+		got := map[string]float64{}
+		for node, count := range countStateNodes(r.NextMap,
+			PlanNextMapOptions{})["master"] {
+			if count > 0 {
+				got[node] = count
+			}
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, test.about, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// A refiner improves a map from the greedy planner by local search,
+// per the LocalSearchOptions.
+type refiner struct {
+	prevMap PartitionMap // The original map, for move costs.
+	nodes   []string     // The nodes that can be assigned partitions.
+	opts    PlanNextMapOptions
+	lso     LocalSearchOptions
+
+	stateNames []string
+	partitions []*Partition // Sorted, for repeatability.
+
+	// The partitions that may be changed, which excludes the
+	// partitions in affinity groups, as they must stay co-located.
+	movable []*Partition
+
+	nodeWeights       map[string]float64
+	hierarchyChildren map[string][]string
+	topStateName      string
+
+	// Key is stateName, value is {node: count}.
+	stateNodeCounts map[string]map[string]float64
+
+	// Keyed by node, value is sum of partitions on that node.
+	nodePartitionCounts map[string]float64
+
+	// Key is stateName, then resource name, value is {node: amount}.
+	stateResourceNodeCounts map[string]map[string]map[string]int
+
+	resourceUnits      map[string]float64
+	nodeResourceScales map[string]map[string]float64
+
+	// Keyed by partitionName, value is the partition's anti-affinity
+	// group names.
+	partitionGroups map[string][]string
+
+	// Key is node, value is {groupName: count of partitions}.
+	nodeGroupCounts map[string]map[string]int
+}
+
+// A refineChange replaces the i'th node of a partition's state.
+type refineChange struct {
+	partition *Partition
+	stateName string
+	i         int
+	node      string
+}
+
+// Returns a refinement of the nextMap, which must have been planned
+// from the prevMap, using local search.
+func refineMap(
+	prevMap PartitionMap,
+	nextMap PartitionMap,
+	nodes []string,
+	model PartitionModel,
+	opts PlanNextMapOptions,
+) PartitionMap {
+	r := newRefiner(prevMap, nextMap, nodes, model, opts)
+	r.run()
+
+	rv := PartitionMap{}
+	for _, partition := range r.partitions {
+		rv[partition.Name] = partition
+	}
+	return rv
+}
+
+// Returns the warnings of the greedy planner, updated for the
+// refinement of the nextMap.  As the refinement only moves and swaps
+// nodes, the number of nodes of each partition's states is unchanged,
+// but the pin and anti-affinity warnings are recomputed, and warnings
+// are added for nodes that are over capacity or that aren't allowed
+// their states, which the refinement only avoids by its cost.
+func refineWarnings(
+	warnings []PlanWarning,
+	nextMap PartitionMap,
+	model PartitionModel,
+	opts PlanNextMapOptions,
+) []PlanWarning {
+	rv := []PlanWarning{}
+
+	type warningKey struct {
+		code                     PlanWarningCode
+		partitionName, stateName string
+	}
+	seen := map[warningKey]bool{}
+
+	add := func(w PlanWarning) {
+		k := warningKey{w.Code, w.Partition, w.StateName}
+		if !seen[k] {
+			seen[k] = true
+			rv = append(rv, w)
+		}
+	}
+
+	for _, w := range warnings {
+		if w.Code != WarningPinNotMet && w.Code != WarningAntiAffinityNotMet {
+			add(w)
+		}
+	}
+
+	// Key is stateName, value is {node: count}.
+	stateNodeCounts := countStateNodes(nextMap, opts)
+
+	addBaselineStateNodeCounts(stateNodeCounts, opts)
+
+	// Keyed by node, value is sum of partitions on that node.
+	nodePartitionCounts := countNodePartitions(stateNodeCounts, opts)
+
+	overCapacity := func(node, stateName string) bool {
+		if c, exists := getNodeCapacity(node, opts); exists &&
+			nodePartitionCounts[node] > float64(c) {
+			return true
+		}
+		if c, exists := opts.NodeStateCapacities[node][stateName]; exists &&
+			stateNodeCounts[stateName][node] > float64(c) {
+			return true
+		}
+		return false
+	}
+
+	antiAffinityPartitions := mapAntiAffinityPartitions(opts.AntiAffinityGroups)
+
+	affinityFollowers := map[string]bool{}
+	for _, members := range mapAffinityGroups(opts.AffinityGroups, nextMap) {
+		for _, member := range members[1:] {
+			affinityFollowers[member.Name] = true
+		}
+	}
+
+	partitionNames := make([]string, 0, len(nextMap))
+	for partitionName := range nextMap {
+		partitionNames = append(partitionNames, partitionName)
+	}
+	sort.Strings(partitionNames)
+
+	for _, stateName := range sortStateNames(model) {
+		stateConstraints := getStateConstraints(stateName, model, opts)
+
+		for _, partitionName := range partitionNames {
+			nodes := nextMap[partitionName].NodesByState[stateName]
+
+			constraints, _ := getPartitionConstraints(partitionName,
+				stateName, stateConstraints, opts)
+
+			if !affinityFollowers[partitionName] {
+				placement := newPlacementRules(partitionName, stateName,
+					nextMap, antiAffinityPartitions, opts)
+				for _, w := range placement.warnings(partitionName,
+					stateName, constraints, nodes) {
+					add(w)
+				}
+			}
+
+			for _, node := range nodes {
+				code := PlanWarningCode("")
+				if overCapacity(node, stateName) {
+					code = WarningInsufficientCapacity
+				} else if !nodeAllowsState(node, stateName, opts) {
+					code = WarningStateNotAllowed
+				}
+				if code != "" {
+					add(PlanWarning{
+						Code:        code,
+						StateName:   stateName,
+						Partition:   partitionName,
+						Constraints: constraints,
+					})
+				}
+			}
+		}
+	}
+
+	return rv
+}
+
+func newRefiner(
+	prevMap PartitionMap,
+	nextMap PartitionMap,
+	nodes []string,
+	model PartitionModel,
+	opts PlanNextMapOptions,
+) *refiner {
+	r := &refiner{
+		prevMap:           prevMap,
+		nodes:             nodes,
+		opts:              opts,
+		stateNames:        sortStateNames(model),
+		partitions:        nextMap.toArrayCopy(),
+		nodeWeights:       mergeWeights(opts.NodeWeights, opts.NodeWeightsFloat),
+		hierarchyChildren: mapParentsToMapChildren(opts.NodeHierarchy),
+	}
+	if len(r.stateNames) > 0 {
+		r.topStateName = r.stateNames[0]
+	}
+
+	if opts.LocalSearch != nil {
+		r.lso = *opts.LocalSearch
+	}
+	if r.lso.MaxIterations <= 0 && r.lso.MaxDuration <= 0 {
+		r.lso.MaxIterations = 100 * len(r.partitions)
+	}
+	if r.lso.ImbalanceCost == 0 {
+		r.lso.ImbalanceCost = 1
+	}
+	if r.lso.MoveCost == 0 {
+		r.lso.MoveCost = 1
+	}
+	if r.lso.ViolationCost == 0 {
+		r.lso.ViolationCost = 1000
+	}
+
+	sort.Sort(&partitionSorter{a: r.partitions})
+
+	partitionsByName := make(map[string]*Partition)
+	for _, partition := range r.partitions {
+		partitionsByName[partition.Name] = partition
+	}
+
+	affinityPartitions := map[string]bool{}
+	for _, members := range mapAffinityGroups(opts.AffinityGroups,
+		partitionsByName) {
+		for _, member := range members {
+			affinityPartitions[member.Name] = true
+		}
+	}
+
+	for _, partition := range r.partitions {
+		if !affinityPartitions[partition.Name] {
+			r.movable = append(r.movable, partition)
+		}
+	}
+
+	r.stateNodeCounts = countStateNodes(nextMap, opts)
+
+	addBaselineStateNodeCounts(r.stateNodeCounts, opts)
+
+	r.nodePartitionCounts = countNodePartitions(r.stateNodeCounts, opts)
+
+	if opts.PartitionResources != nil {
+		r.stateResourceNodeCounts =
+			countStateNodeResources(nextMap, opts.PartitionResources)
+
+		r.resourceUnits, r.nodeResourceScales =
+			calcResourceScales(nextMap, nodes,
+				opts.PartitionResources, opts.NodeResources)
+	}
+
+	r.partitionGroups = make(map[string][]string)
+	for groupName, partitionNames := range opts.AntiAffinityGroups {
+		for _, partitionName := range partitionNames {
+			r.partitionGroups[partitionName] =
+				append(r.partitionGroups[partitionName], groupName)
+		}
+	}
+
+	r.nodeGroupCounts = make(map[string]map[string]int)
+	for _, partition := range r.partitions {
+		for _, node := range flattenNodesByState(partition.NodesByState) {
+			r.adjustNodeGroupCounts(partition.Name, node, 1)
+		}
+	}
+
+	return r
+}
+
+func (r *refiner) adjustNodeGroupCounts(partitionName, node string,
+	amt int) {
+	for _, groupName := range r.partitionGroups[partitionName] {
+		m, exists := r.nodeGroupCounts[node]
+		if !exists {
+			m = make(map[string]int)
+			r.nodeGroupCounts[node] = m
+		}
+		m[groupName] = m[groupName] + amt
+	}
+}
+
+// Runs the local search, leaving the best found assignments in the
+// r.partitions.
+func (r *refiner) run() {
+	if len(r.movable) <= 0 || len(r.nodes) <= 0 || len(r.stateNames) <= 0 {
+		return
+	}
+
+	rng := rand.New(rand.NewSource(r.lso.Seed))
+
+	start := time.Now()
+
+	cost := r.cost()
+
+	// With annealing, uphill changes are accepted, so the best
+	// assignments so far, starting with the given assignments, are
+	// kept to be restored at the end.
+	bestCost := cost
+	var best []map[string][]string
+	if r.lso.Temperature > 0 {
+		best = r.snapshot()
+	}
+
+	for i := 0; r.lso.MaxIterations <= 0 || i < r.lso.MaxIterations; i++ {
+		progress := 0.0
+		if r.lso.MaxIterations > 0 {
+			progress = float64(i) / float64(r.lso.MaxIterations)
+		}
+		if r.lso.MaxDuration > 0 {
+			elapsed := time.Since(start)
+			if elapsed >= r.lso.MaxDuration {
+				break
+			}
+			progress = math.Max(progress,
+				float64(elapsed)/float64(r.lso.MaxDuration))
+		}
+
+		changes := r.randomChanges(rng)
+		if len(changes) <= 0 {
+			continue
+		}
+
+		delta := r.apply(changes)
+
+		temperature := r.lso.Temperature * (1 - progress)
+		if delta < -1e-9 ||
+			(temperature > 0 && rng.Float64() < math.Exp(-delta/temperature)) {
+			cost = cost + delta
+			if r.lso.Temperature > 0 && cost < bestCost-1e-9 {
+				bestCost = cost
+				best = r.snapshot()
+			}
+		} else {
+			r.revert(changes)
+		}
+	}
+
+	if best != nil && cost > bestCost+1e-9 {
+		for i, partition := range r.partitions {
+			partition.NodesByState = best[i]
+		}
+	}
+}
+
+func (r *refiner) snapshot() []map[string][]string {
+	rv := make([]map[string][]string, len(r.partitions))
+	for i, partition := range r.partitions {
+		rv[i] = copyNodesByState(partition.NodesByState)
+	}
+	return rv
+}
+
+// Returns a random, valid candidate set of changes: either a move of
+// one of a partition's nodes to another node, a swap of nodes between
+// two partitions in the same state, or a swap of the states of two
+// nodes of the same partition (e.g., promote a slave to master and
+// demote the master to slave).  Returns nil if the random pick was
+// not valid.
+func (r *refiner) randomChanges(rng *rand.Rand) []refineChange {
+	p := r.movable[rng.Intn(len(r.movable))]
+	stateName := r.stateNames[rng.Intn(len(r.stateNames))]
+	nodes := p.NodesByState[stateName]
+	if len(nodes) <= 0 {
+		return nil
+	}
+	i := rng.Intn(len(nodes))
+
+	switch rng.Intn(3) {
+	case 0: // Move.
+		node := r.nodes[rng.Intn(len(r.nodes))]
+		if r.hasNode(p, node) {
+			return nil
+		}
+		return []refineChange{{p, stateName, i, node}}
+
+	case 1: // Swap between partitions.
+		p2 := r.movable[rng.Intn(len(r.movable))]
+		nodes2 := p2.NodesByState[stateName]
+		if p2 == p || len(nodes2) <= 0 {
+			return nil
+		}
+		i2 := rng.Intn(len(nodes2))
+		if r.hasNode(p, nodes2[i2]) || r.hasNode(p2, nodes[i]) {
+			return nil
+		}
+		return []refineChange{
+			{p, stateName, i, nodes2[i2]},
+			{p2, stateName, i2, nodes[i]},
+		}
+
+	default: // Swap between states.
+		stateName2 := r.stateNames[rng.Intn(len(r.stateNames))]
+		nodes2 := p.NodesByState[stateName2]
+		if stateName2 == stateName || len(nodes2) <= 0 {
+			return nil
+		}
+		i2 := rng.Intn(len(nodes2))
+		return []refineChange{
+			{p, stateName, i, nodes2[i2]},
+			{p, stateName2, i2, nodes[i]},
+		}
+	}
+}
+
+func (r *refiner) hasNode(partition *Partition, node string) bool {
+	for _, nodes := range partition.NodesByState {
+		if len(StringsIntersectStrings(nodes, []string{node})) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies the changes and returns the resulting change in cost.
+func (r *refiner) apply(changes []refineChange) float64 {
+	before := r.changesCost(changes)
+	for i := range changes {
+		changes[i].node = r.set(changes[i])
+	}
+	return r.changesCost(changes) - before
+}
+
+// Reverts changes that were applied, where apply() has swapped the
+// previous nodes into the changes.
+func (r *refiner) revert(changes []refineChange) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		changes[i].node = r.set(changes[i])
+	}
+}
+
+// Sets the node of a partition's state, keeping the counts updated,
+// and returns the previous node.
+func (r *refiner) set(c refineChange) string {
+	nodes := c.partition.NodesByState[c.stateName]
+	prevNode := nodes[c.i]
+
+	partitionWeight := getPartitionWeight(c.partition.Name, c.stateName, r.opts)
+
+	adjustStateNodeCounts(r.stateNodeCounts, c.stateName,
+		[]string{prevNode}, -partitionWeight)
+	adjustStateNodeCounts(r.stateNodeCounts, c.stateName,
+		[]string{c.node}, partitionWeight)
+
+	r.nodePartitionCounts[prevNode] =
+		r.nodePartitionCounts[prevNode] - partitionWeight
+	r.nodePartitionCounts[c.node] =
+		r.nodePartitionCounts[c.node] + partitionWeight
+
+	if r.stateResourceNodeCounts != nil {
+		partitionResources := r.opts.PartitionResources[c.partition.Name]
+		adjustStateNodeResources(r.stateResourceNodeCounts, c.stateName,
+			[]string{prevNode}, partitionResources, -1)
+		adjustStateNodeResources(r.stateResourceNodeCounts, c.stateName,
+			[]string{c.node}, partitionResources, 1)
+	}
+
+	r.adjustNodeGroupCounts(c.partition.Name, prevNode, -1)
+	r.adjustNodeGroupCounts(c.partition.Name, c.node, 1)
+
+	nodes[c.i] = c.node
+
+	return prevNode
+}
+
+// Returns the cost of the nodes and partitions that are touched by
+// the changes.
+func (r *refiner) changesCost(changes []refineChange) float64 {
+	var nodes []string
+	var partitions []*Partition
+	for _, c := range changes {
+		nodes = append(nodes,
+			c.node, c.partition.NodesByState[c.stateName][c.i])
+		partitions = append(partitions, c.partition)
+	}
+	nodes = StringsIntersectStrings(nodes, nodes) // Dedupe.
+
+	rv := 0.0
+	for _, node := range nodes {
+		rv = rv + r.nodeCost(node)
+	}
+	for i, partition := range partitions {
+		if i == 0 || partition != partitions[i-1] {
+			rv = rv + r.partitionCost(partition)
+		}
+	}
+	return rv
+}
+
+// Returns the total cost of the current assignments.
+func (r *refiner) cost() float64 {
+	rv := 0.0
+	for _, node := range r.nodes {
+		rv = rv + r.nodeCost(node)
+	}
+	for _, partition := range r.partitions {
+		rv = rv + r.partitionCost(partition)
+	}
+	return rv
+}
+
+// Returns the imbalance and capacity violation cost of a node.
+func (r *refiner) nodeCost(node string) float64 {
+	nodeWeight := 1.0
+	if w, exists := r.nodeWeights[node]; exists && w > 0 {
+		nodeWeight = w
+	}
+
+	imbalance := 0.0
+	for _, stateName := range r.stateNames {
+		load := r.stateNodeCounts[stateName][node]
+		imbalance = imbalance + load*load/nodeWeight
+
+		for resource, resourceNodeCounts := range r.stateResourceNodeCounts[stateName] {
+			units := r.resourceUnits[resource]
+			if units <= 0 {
+				continue
+			}
+			scale := 1.0
+			if s, exists := r.nodeResourceScales[node][resource]; exists && s > 0 {
+				scale = s
+			}
+			u := float64(resourceNodeCounts[node]) / units
+			imbalance = imbalance + u*u/scale
+		}
+	}
+
+	load := r.nodePartitionCounts[node]
+	imbalance = imbalance + load*load/nodeWeight
+
+	violations := 0.0
+	if c, exists := getNodeCapacity(node, r.opts); exists {
+		violations = violations + math.Max(0, load-float64(c))
+	}
+	for _, stateName := range r.stateNames {
+		if !nodeAllowsState(node, stateName, r.opts) {
+			violations = violations + r.stateNodeCounts[stateName][node]
+		}
+	}
+	for stateName, c := range r.opts.NodeStateCapacities[node] {
+		violations = violations +
+			math.Max(0, r.stateNodeCounts[stateName][node]-float64(c))
+	}
+	for _, count := range r.nodeGroupCounts[node] {
+		if count > 1 {
+			violations = violations + float64(count-1)
+		}
+	}
+
+	return r.lso.ImbalanceCost*imbalance + r.lso.ViolationCost*violations
+}
+
+// Returns the move and hierarchy violation cost of a partition.
+func (r *refiner) partitionCost(partition *Partition) float64 {
+	var prevNodesByState map[string][]string
+	if prevPartition := r.prevMap[partition.Name]; prevPartition != nil {
+		prevNodesByState = prevPartition.NodesByState
+	}
+
+	moves := 0.0
+	for stateName, nodes := range partition.NodesByState {
+		for _, node := range nodes {
+			if len(StringsIntersectStrings(prevNodesByState[stateName],
+				[]string{node})) <= 0 {
+				moves = moves + getStickiness(partition.Name, stateName, r.opts)
+			}
+		}
+	}
+
+	violations := 0.0
+	for stateName, pinnedNodes := range r.opts.PartitionPins[partition.Name] {
+		violations = violations + float64(len(StringsRemoveStrings(
+			partition.NodesByState[stateName], pinnedNodes)))
+	}
+
+	if r.opts.HierarchyRules != nil {
+		topPriorityNode := ""
+		if nodes := partition.NodesByState[r.topStateName]; len(nodes) > 0 {
+			topPriorityNode = nodes[0]
+		}
+
+		for stateName, rules := range r.opts.HierarchyRules {
+			nodes := partition.NodesByState[stateName]
+			for i, rule := range rules {
+				if i >= len(nodes) {
+					break
+				}
+				h := topPriorityNode
+				if h == "" {
+					if i == 0 {
+						continue
+					}
+					h = nodes[0]
+				}
+				hierarchyCandidates := includeExcludeNodes(h,
+					rule.IncludeLevel, rule.ExcludeLevel,
+					r.opts.NodeHierarchy, r.hierarchyChildren)
+				if len(StringsIntersectStrings(hierarchyCandidates,
+					[]string{nodes[i]})) <= 0 {
+					violations = violations + 1
+				}
+			}
+		}
+	}
+
+	return r.lso.MoveCost*moves + r.lso.ViolationCost*violations
+}
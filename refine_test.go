@@ -0,0 +1,342 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRefineMap(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	tests := []struct {
+		About   string
+		nextMap PartitionMap
+		nodes   []string
+		opts    PlanNextMapOptions
+		exp     map[string]map[string]float64 // Keyed by state, node.
+	}{
+		{
+			About: "moves balance the masters",
+			nextMap: PartitionMap{
+				"0": &Partition{Name: "0",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"1": &Partition{Name: "1",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"2": &Partition{Name: "2",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"3": &Partition{Name: "3",
+					NodesByState: map[string][]string{"master": {"a"}}},
+			},
+			nodes: []string{"a", "b"},
+			exp: map[string]map[string]float64{
+				"master": {"a": 2, "b": 2},
+			},
+		},
+		{
+			About: "node capacity is respected",
+			nextMap: PartitionMap{
+				"0": &Partition{Name: "0",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"1": &Partition{Name: "1",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"2": &Partition{Name: "2",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"3": &Partition{Name: "3",
+					NodesByState: map[string][]string{"master": {"a"}}},
+			},
+			nodes: []string{"a", "b"},
+			opts: PlanNextMapOptions{
+				NodeCapacities: map[string]int{"b": 1},
+			},
+			exp: map[string]map[string]float64{
+				"master": {"a": 3, "b": 1},
+			},
+		},
+		{
+			About: "state swaps balance the masters",
+			nextMap: PartitionMap{
+				"0": &Partition{Name: "0",
+					NodesByState: map[string][]string{
+						"master": {"a"}, "slave": {"b"}}},
+				"1": &Partition{Name: "1",
+					NodesByState: map[string][]string{
+						"master": {"a"}, "slave": {"b"}}},
+			},
+			nodes: []string{"a", "b"},
+			exp: map[string]map[string]float64{
+				"master": {"a": 1, "b": 1},
+				"slave":  {"a": 1, "b": 1},
+			},
+		},
+		{
+			About: "swaps balance weighted partitions",
+			nextMap: PartitionMap{
+				"0": &Partition{Name: "0",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"1": &Partition{Name: "1",
+					NodesByState: map[string][]string{"master": {"a"}}},
+				"2": &Partition{Name: "2",
+					NodesByState: map[string][]string{"master": {"b"}}},
+				"3": &Partition{Name: "3",
+					NodesByState: map[string][]string{"master": {"b"}}},
+			},
+			nodes: []string{"a", "b"},
+			opts: PlanNextMapOptions{
+				PartitionWeights: map[string]int{"0": 3, "1": 3},
+			},
+			exp: map[string]map[string]float64{
+				"master": {"a": 4, "b": 4},
+			},
+		},
+	}
+	for i, c := range tests {
+		c.opts.LocalSearch = &LocalSearchOptions{MoveCost: 0.01}
+
+		r := refineMap(c.nextMap, c.nextMap, c.nodes, model, c.opts)
+
+		got := countStateNodes(r, c.opts)
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %#v, got: %#v, r: %v",
+				i, c.About, c.exp, got, r)
+		}
+
+		// The input map should not be changed.
+		for _, partition := range c.nextMap {
+			if len(partition.NodesByState["master"]) != 1 {
+				t.Errorf("i: %d, about: %s, nextMap changed: %v",
+					i, c.About, c.nextMap)
+			}
+		}
+	}
+}
+
+func TestPlanNextMapLocalSearch(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d", "e"}
+	prevMap := PartitionMap{}
+	partitionWeights := map[string]int{}
+	for i := 0; i < 64; i++ {
+		partitionName := fmt.Sprintf("%03d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+		partitionWeights[partitionName] = i%7 + 1
+	}
+	opts := PlanNextMapOptions{
+		PartitionWeights: partitionWeights,
+		NodeWeights:      map[string]int{"a": 2, "b": 2, "c": 1, "d": 1, "e": 1},
+	}
+
+	greedyMap, warnings := PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, model, opts)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+
+	opts.LocalSearch = &LocalSearchOptions{Seed: 1}
+
+	refinedMap, warnings := PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, model, opts)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+
+	refinedMap2, _ := PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, model, opts)
+	if !reflect.DeepEqual(refinedMap, refinedMap2) {
+		t.Errorf("expected the same refinement with the same seed")
+	}
+
+	greedyCost := newRefiner(prevMap, greedyMap, nodes, model, opts).cost()
+	refinedCost := newRefiner(prevMap, refinedMap, nodes, model, opts).cost()
+	if refinedCost > greedyCost {
+		t.Errorf("expected refinement to not increase cost,"+
+			" greedyCost: %f, refinedCost: %f", greedyCost, refinedCost)
+	}
+
+	for partitionName, partition := range refinedMap {
+		if len(partition.NodesByState["master"]) != 1 ||
+			len(partition.NodesByState["slave"]) != 1 ||
+			partition.NodesByState["master"][0] ==
+				partition.NodesByState["slave"][0] {
+			t.Errorf("partition: %s, bad refinement: %v",
+				partitionName, partition.NodesByState)
+		}
+	}
+}
+
+func TestPlanNextMapLocalSearchEmptyModel(t *testing.T) {
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{}},
+	}
+	opts := PlanNextMapOptions{LocalSearch: &LocalSearchOptions{}}
+
+	nextMap, _ := PlanNextMapEx(prevMap,
+		[]string{"a"}, nil, nil, PartitionModel{}, opts)
+	if len(nextMap) != 1 || nextMap["0"] == nil {
+		t.Errorf("expected the partition to be kept, got: %#v", nextMap)
+	}
+}
+
+func TestRefineMapPlacementRules(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	nextMap := PartitionMap{
+		"0": &Partition{Name: "0",
+			NodesByState: map[string][]string{"master": {"a"}}},
+		"1": &Partition{Name: "1",
+			NodesByState: map[string][]string{"master": {"a"}}},
+		"2": &Partition{Name: "2",
+			NodesByState: map[string][]string{"master": {"b"}}},
+		"3": &Partition{Name: "3",
+			NodesByState: map[string][]string{"master": {"b"}}},
+	}
+	opts := PlanNextMapOptions{
+		PartitionPins: map[string]map[string][]string{
+			"2": {"master": {"a"}},
+		},
+		AntiAffinityGroups: map[string][]string{
+			"g": {"0", "1"},
+		},
+		LocalSearch: &LocalSearchOptions{},
+	}
+
+	r := refineMap(nextMap, nextMap, []string{"a", "b"}, model, opts)
+
+	if !reflect.DeepEqual(r["2"].NodesByState["master"], []string{"a"}) {
+		t.Errorf("expected pin to be met, got: %v", r)
+	}
+	if r["0"].NodesByState["master"][0] == r["1"].NodesByState["master"][0] {
+		t.Errorf("expected anti-affinity to be met, got: %v", r)
+	}
+	exp := map[string]map[string]float64{
+		"master": {"a": 2, "b": 2},
+	}
+	if got := countStateNodes(r, opts); !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp: %v, got: %v", exp, got)
+	}
+}
+
+func TestRefineMapAnnealing(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+	prevMap := PartitionMap{}
+	partitionWeights := map[string]int{}
+	for i := 0; i < 16; i++ {
+		partitionName := fmt.Sprintf("%03d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+		partitionWeights[partitionName] = i%5 + 1
+	}
+	opts := PlanNextMapOptions{PartitionWeights: partitionWeights}
+
+	greedyMap, _ := PlanNextMapEx(prevMap,
+		nodes, []string{}, nodes, model, opts)
+
+	for seed := int64(0); seed < 20; seed++ {
+		opts.LocalSearch = &LocalSearchOptions{
+			Seed:          seed,
+			MaxIterations: 200,
+			Temperature:   50,
+		}
+
+		refinedMap := refineMap(prevMap, greedyMap, nodes, model, opts)
+
+		greedyCost := newRefiner(prevMap, greedyMap, nodes, model, opts).cost()
+		refinedCost := newRefiner(prevMap, refinedMap, nodes, model, opts).cost()
+		if refinedCost > greedyCost {
+			t.Errorf("seed: %d, expected annealing to not increase cost,"+
+				" greedyCost: %f, refinedCost: %f",
+				seed, greedyCost, refinedCost)
+		}
+	}
+}
+
+func TestRefineWarnings(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	nextMap := PartitionMap{
+		"0": &Partition{Name: "0",
+			NodesByState: map[string][]string{"master": {"a"}}},
+		"1": &Partition{Name: "1",
+			NodesByState: map[string][]string{"master": {"b"}}},
+		"2": &Partition{Name: "2",
+			NodesByState: map[string][]string{"master": {"b"}}},
+		"3": &Partition{Name: "3",
+			NodesByState: map[string][]string{}},
+	}
+	opts := PlanNextMapOptions{
+		NodeCapacities: map[string]int{"b": 1},
+		PartitionPins: map[string]map[string][]string{
+			"2": {"master": {"a"}},
+		},
+		AntiAffinityGroups: map[string][]string{
+			"g": {"0", "1"},
+		},
+	}
+
+	// The greedy warnings from before the refinement, where the
+	// anti-affinity warning is stale.
+	warnings := []PlanWarning{
+		{Code: WarningConstraintsNotMet, StateName: "master",
+			Partition: "3", Constraints: 1},
+		{Code: WarningAntiAffinityNotMet, StateName: "master",
+			Partition: "1", Constraints: 1},
+	}
+
+	exp := []PlanWarning{
+		{Code: WarningConstraintsNotMet, StateName: "master",
+			Partition: "3", Constraints: 1},
+		{Code: WarningInsufficientCapacity, StateName: "master",
+			Partition: "1", Constraints: 1},
+		{Code: WarningPinNotMet, StateName: "master",
+			Partition: "2", Constraints: 1},
+		{Code: WarningInsufficientCapacity, StateName: "master",
+			Partition: "2", Constraints: 1},
+	}
+	got := refineWarnings(warnings, nextMap, model, opts)
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp: %v, got: %v", exp, got)
+	}
+}
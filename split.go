@@ -0,0 +1,158 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// PlanSplitPartition computes the steps to split the parent partition
+// into the children partitions, as a sequence of partition maps that
+// starts with the currMap.  Each pair of adjacent maps in the
+// sequence is meant to be the begMap and endMap of an
+// OrchestrateMoves() invocation, and all the maps have the same
+// partitions (the partitions of the currMap plus the children).
+//
+// The children are first added with the same nodes and states as the
+// parent, so that the application can split the parent's data
+// locally when the children are assigned, and then the parent is
+// removed from all its nodes.  After the last step, the application
+// should drop the parent from the map, and may then use
+// PlanNextMapEx() to rebalance the children across the nodes.
+func PlanSplitPartition(currMap PartitionMap,
+	parent string, children []string) ([]PartitionMap, error) {
+	parentPartition, exists := currMap[parent]
+	if !exists || parentPartition == nil {
+		return nil, fmt.Errorf("split: unknown parent partition: %s", parent)
+	}
+	err := checkNewPartitions(currMap, children)
+	if err != nil {
+		return nil, fmt.Errorf("split: %v", err)
+	}
+
+	beg := copyPartitionMap(currMap)
+	for _, child := range children {
+		beg[child] = &Partition{
+			Name:         child,
+			NodesByState: map[string][]string{},
+		}
+	}
+
+	// Add the children, co-located with the parent.
+	added := copyPartitionMap(beg)
+	for _, child := range children {
+		added[child].NodesByState =
+			copyNodesByState(parentPartition.NodesByState)
+	}
+
+	// Remove the parent.
+	removed := copyPartitionMap(added)
+	removed[parent].NodesByState = map[string][]string{}
+
+	return []PartitionMap{beg, added, removed}, nil
+}
+
+// PlanMergePartitions computes the steps to merge the children
+// partitions into a new parent partition, as a sequence of partition
+// maps that starts with the currMap, similar to PlanSplitPartition().
+//
+// The children are first moved so they're co-located on the nodes
+// and states of the parentNodesByState, then the parent is added on
+// those same nodes, so that the application can merge the children's
+// data locally when the parent is assigned, and then the children are
+// removed from all their nodes.  When the parentNodesByState is nil,
+// the parent is placed like the first child.  After the last step,
+// the application should drop the children from the map.
+func PlanMergePartitions(currMap PartitionMap,
+	children []string, parent string,
+	parentNodesByState map[string][]string) ([]PartitionMap, error) {
+	if len(children) <= 0 {
+		return nil, fmt.Errorf("merge: no children partitions")
+	}
+	for i, child := range children {
+		childPartition, exists := currMap[child]
+		if !exists || childPartition == nil {
+			return nil, fmt.Errorf("merge: unknown child partition: %s", child)
+		}
+		for _, prevChild := range children[0:i] {
+			if prevChild == child {
+				return nil, fmt.Errorf("merge: duplicate child partition: %s",
+					child)
+			}
+		}
+	}
+	err := checkNewPartitions(currMap, []string{parent})
+	if err != nil {
+		return nil, fmt.Errorf("merge: %v", err)
+	}
+
+	if parentNodesByState == nil {
+		parentNodesByState = currMap[children[0]].NodesByState
+	}
+
+	beg := copyPartitionMap(currMap)
+	beg[parent] = &Partition{
+		Name:         parent,
+		NodesByState: map[string][]string{},
+	}
+
+	// Co-locate the children.
+	colocated := copyPartitionMap(beg)
+	for _, child := range children {
+		colocated[child].NodesByState = copyNodesByState(parentNodesByState)
+	}
+
+	// Add the parent, co-located with the children.
+	added := copyPartitionMap(colocated)
+	added[parent].NodesByState = copyNodesByState(parentNodesByState)
+
+	// Remove the children.
+	removed := copyPartitionMap(added)
+	for _, child := range children {
+		removed[child].NodesByState = map[string][]string{}
+	}
+
+	rv := []PartitionMap{beg}
+	if !reflect.DeepEqual(colocated, beg) {
+		rv = append(rv, colocated)
+	}
+	return append(rv, added, removed), nil
+}
+
+// Returns an error if any of the partitions are already in the
+// partition map, or are duplicated, or if there are no partitions.
+func checkNewPartitions(m PartitionMap, partitions []string) error {
+	if len(partitions) <= 0 {
+		return fmt.Errorf("no partitions")
+	}
+	for i, partition := range partitions {
+		if _, exists := m[partition]; exists {
+			return fmt.Errorf("partition already exists: %s", partition)
+		}
+		for _, prevPartition := range partitions[0:i] {
+			if prevPartition == partition {
+				return fmt.Errorf("duplicate partition: %s", partition)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a deep copy of the partition map.
+func copyPartitionMap(m PartitionMap) PartitionMap {
+	rv := PartitionMap{}
+	for _, partition := range m.toArrayCopy() {
+		rv[partition.Name] = partition
+	}
+	return rv
+}
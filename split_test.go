@@ -0,0 +1,232 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPlanSplitPartition(t *testing.T) {
+	currMap := PartitionMap{
+		"0": &Partition{Name: "0",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "replica": {"b"}}},
+		"1": &Partition{Name: "1",
+			NodesByState: map[string][]string{
+				"master": {"b"}, "replica": {"a"}}},
+	}
+
+	steps, err := PlanSplitPartition(currMap, "0", []string{"0a", "0b"})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	exp := []map[string]map[string][]string{
+		{
+			"0":  {"master": {"a"}, "replica": {"b"}},
+			"1":  {"master": {"b"}, "replica": {"a"}},
+			"0a": {},
+			"0b": {},
+		},
+		{
+			"0":  {"master": {"a"}, "replica": {"b"}},
+			"1":  {"master": {"b"}, "replica": {"a"}},
+			"0a": {"master": {"a"}, "replica": {"b"}},
+			"0b": {"master": {"a"}, "replica": {"b"}},
+		},
+		{
+			"0":  {},
+			"1":  {"master": {"b"}, "replica": {"a"}},
+			"0a": {"master": {"a"}, "replica": {"b"}},
+			"0b": {"master": {"a"}, "replica": {"b"}},
+		},
+	}
+	testCheckPartitionMapSteps(t, "split", steps, exp)
+
+	if len(currMap) != 2 {
+		t.Errorf("expected currMap to be unchanged, got: %v", currMap)
+	}
+
+	testOrchestratePartitionMapSteps(t, "split", []string{"a", "b"}, steps)
+
+	_, err = PlanSplitPartition(currMap, "x", []string{"xa"})
+	if err == nil {
+		t.Errorf("expected err on unknown parent")
+	}
+	_, err = PlanSplitPartition(currMap, "0", []string{"1"})
+	if err == nil {
+		t.Errorf("expected err on existing child")
+	}
+	_, err = PlanSplitPartition(currMap, "0", []string{"0a", "0a"})
+	if err == nil {
+		t.Errorf("expected err on duplicate child")
+	}
+	_, err = PlanSplitPartition(currMap, "0", nil)
+	if err == nil {
+		t.Errorf("expected err on no children")
+	}
+}
+
+func TestPlanMergePartitions(t *testing.T) {
+	currMap := PartitionMap{
+		"0a": &Partition{Name: "0a",
+			NodesByState: map[string][]string{
+				"master": {"a"}, "replica": {"b"}}},
+		"0b": &Partition{Name: "0b",
+			NodesByState: map[string][]string{
+				"master": {"b"}, "replica": {"c"}}},
+	}
+
+	steps, err := PlanMergePartitions(currMap,
+		[]string{"0a", "0b"}, "0", nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+
+	exp := []map[string]map[string][]string{
+		{
+			"0a": {"master": {"a"}, "replica": {"b"}},
+			"0b": {"master": {"b"}, "replica": {"c"}},
+			"0":  {},
+		},
+		{
+			"0a": {"master": {"a"}, "replica": {"b"}},
+			"0b": {"master": {"a"}, "replica": {"b"}},
+			"0":  {},
+		},
+		{
+			"0a": {"master": {"a"}, "replica": {"b"}},
+			"0b": {"master": {"a"}, "replica": {"b"}},
+			"0":  {"master": {"a"}, "replica": {"b"}},
+		},
+		{
+			"0a": {},
+			"0b": {},
+			"0":  {"master": {"a"}, "replica": {"b"}},
+		},
+	}
+	testCheckPartitionMapSteps(t, "merge", steps, exp)
+
+	testOrchestratePartitionMapSteps(t, "merge",
+		[]string{"a", "b", "c"}, steps)
+
+	// Already co-located children skip the co-locate step.
+	steps2, err := PlanMergePartitions(steps[1],
+		[]string{"0a", "0b"}, "1", nil)
+	if err != nil || len(steps2) != 3 {
+		t.Errorf("expected 3 steps, got: %v, err: %v", steps2, err)
+	}
+	steps2, err = PlanMergePartitions(steps[1],
+		[]string{"0a", "0b"}, "1", map[string][]string{"master": {"c"}})
+	if err != nil || len(steps2) != 4 {
+		t.Errorf("expected 4 steps, got: %v, err: %v", steps2, err)
+	}
+
+	_, err = PlanMergePartitions(currMap, []string{"0a", "x"}, "0", nil)
+	if err == nil {
+		t.Errorf("expected err on unknown child")
+	}
+	_, err = PlanMergePartitions(currMap, []string{"0a", "0a"}, "0", nil)
+	if err == nil {
+		t.Errorf("expected err on duplicate child")
+	}
+	_, err = PlanMergePartitions(currMap, []string{"0a"}, "0b", nil)
+	if err == nil {
+		t.Errorf("expected err on existing parent")
+	}
+	_, err = PlanMergePartitions(currMap, nil, "0", nil)
+	if err == nil {
+		t.Errorf("expected err on no children")
+	}
+}
+
+func testCheckPartitionMapSteps(t *testing.T, about string,
+	steps []PartitionMap, exp []map[string]map[string][]string) {
+	if len(steps) != len(exp) {
+		t.Errorf("%s: expected %d steps, got: %d", about, len(exp), len(steps))
+		return
+	}
+	for i, step := range steps {
+		got := map[string]map[string][]string{}
+		for partitionName, partition := range step {
+			if partition.Name != partitionName {
+				t.Errorf("%s: i: %d, mismatched name: %s", about, i, partitionName)
+			}
+			got[partitionName] = partition.NodesByState
+		}
+		if !reflect.DeepEqual(got, exp[i]) {
+			t.Errorf("%s: i: %d, exp: %v, got: %v", about, i, exp[i], got)
+		}
+	}
+}
+
+// Runs OrchestrateMoves() for every pair of adjacent steps, checking
+// that the assignments reach the last step.
+func testOrchestratePartitionMapSteps(t *testing.T, about string,
+	nodes []string, steps []PartitionMap) {
+	var m sync.Mutex
+
+	// Keyed by partition, then node, value is state.
+	curr := map[string]map[string]string{}
+	for partitionName, partition := range steps[0] {
+		curr[partitionName] = map[string]string{}
+		for state, nodes := range partition.NodesByState {
+			for _, node := range nodes {
+				curr[partitionName][node] = state
+			}
+		}
+	}
+
+	assignPartition := func(stopCh chan struct{},
+		partition, node, state, op string) error {
+		m.Lock()
+		if state == "" {
+			delete(curr[partition], node)
+		} else {
+			curr[partition][node] = state
+		}
+		m.Unlock()
+		return nil
+	}
+
+	for i := 1; i < len(steps); i++ {
+		o, err := OrchestrateMoves(mrPartitionModel, options1, nodes,
+			steps[i-1], steps[i], assignPartition,
+			LowestWeightPartitionMoveForNode)
+		if err != nil {
+			t.Errorf("%s: i: %d, expected no err, got: %v", about, i, err)
+			return
+		}
+		for progress := range o.ProgressCh() {
+			if len(progress.Errors) > 0 {
+				t.Errorf("%s: i: %d, progress errors: %v",
+					about, i, progress.Errors)
+			}
+		}
+		o.Stop()
+	}
+
+	exp := map[string]map[string]string{}
+	for partitionName, partition := range steps[len(steps)-1] {
+		exp[partitionName] = map[string]string{}
+		for state, nodes := range partition.NodesByState {
+			for _, node := range nodes {
+				exp[partitionName][node] = state
+			}
+		}
+	}
+	if !reflect.DeepEqual(curr, exp) {
+		t.Errorf("%s: exp: %v, got: %v", about, exp, curr)
+	}
+}
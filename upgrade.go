@@ -0,0 +1,207 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A RollingUpgradeStep is one of the steps of a rolling upgrade, as
+// returned by PlanRollingUpgrade().
+type RollingUpgradeStep struct {
+	// Node is the node that's upgraded in this step.
+	Node string
+
+	// Down is true when the Node is about to be taken down, where the
+	// Map has none of the top priority state's partitions on the
+	// Node, and is false when the Node has been upgraded and is
+	// restored, where the Map is the same as before the Node went
+	// down.
+	Down bool
+
+	// Map is the partition map of this step.
+	Map PartitionMap
+
+	// Moves are the moves to go from the previous step's Map (or from
+	// the currMap, for the first step) to this step's Map, keyed by
+	// partitionName, like the PlanResult.Moves.
+	Moves map[string][]NodeStateOp
+
+	// Warnings are from the planning of this step, if any.
+	Warnings []string
+}
+
+// PlanRollingUpgrade computes the steps of a rolling upgrade, where
+// the nodes of the nodesOrder are taken down and upgraded one at a
+// time, in order, so that every partition keeps a node in the top
+// priority state (e.g., "master") throughout.  There are two steps
+// per node, where the first step moves the node's partitions of the
+// top priority state elsewhere, before the node goes down, and the
+// second step restores the node's partitions, after the node is
+// upgraded.  The Map of each step is meant to be the endMap of an
+// OrchestrateMoves() invocation, where the begMap is the Map of the
+// previous step.
+//
+// Before a node goes down, each of its top priority partitions is
+// preferably swapped with a replica on another node (in the next
+// highest priority state that has one), which needs only promote and
+// demote operations and no data copies.  The top priority partitions
+// that have no replicas are instead moved to other nodes, like with
+// the IncrementalConstraints and NodeDrains options, where only those
+// partitions are re-planned, and only in the top priority state, so
+// a step has no data copies for the other partitions.
+func PlanRollingUpgrade(
+	currMap PartitionMap,
+	nodesAll []string,
+	nodesOrder []string,
+	model PartitionModel,
+	opts PlanNextMapOptions,
+) ([]*RollingUpgradeStep, error) {
+	stateNames := sortStateNames(model)
+	if len(stateNames) <= 0 {
+		return nil, fmt.Errorf("upgrade: empty model")
+	}
+	topStateName := stateNames[0]
+
+	for i, node := range nodesOrder {
+		if len(StringsIntersectStrings(nodesAll, []string{node})) <= 0 {
+			return nil, fmt.Errorf("upgrade: node: %s, is not in nodesAll",
+				node)
+		}
+		for _, prevNode := range nodesOrder[0:i] {
+			if prevNode == node {
+				return nil, fmt.Errorf("upgrade: duplicate node: %s", node)
+			}
+		}
+	}
+
+	var steps []*RollingUpgradeStep
+
+	upMap := currMap
+
+	for _, node := range nodesOrder {
+		downMap := copyPartitionMap(upMap)
+
+		// Key is stateName, value is {node: count}.
+		stateNodeCounts := countStateNodes(downMap, opts)
+
+		// Swap the node's top priority partitions with replicas,
+		// favoring the replica nodes with the least top priority load.
+		partitionNames := make([]string, 0, len(downMap))
+		for partitionName := range downMap {
+			partitionNames = append(partitionNames, partitionName)
+		}
+		sort.Strings(partitionNames)
+
+		for _, partitionName := range partitionNames {
+			partition := downMap[partitionName]
+			topNodes := partition.NodesByState[topStateName]
+
+			i := -1
+			for j, topNode := range topNodes {
+				if topNode == node {
+					i = j
+				}
+			}
+			if i < 0 {
+				continue
+			}
+
+			for _, stateName := range stateNames[1:] {
+				stateNodes := partition.NodesByState[stateName]
+
+				best := -1
+				for j, replica := range stateNodes {
+					if replica != node &&
+						len(StringsIntersectStrings(topNodes,
+							[]string{replica})) <= 0 &&
+						(best < 0 || stateNodeCounts[topStateName][replica] <
+							stateNodeCounts[topStateName][stateNodes[best]]) {
+						best = j
+					}
+				}
+				if best < 0 {
+					continue
+				}
+
+				replica := stateNodes[best]
+
+				topNodes[i] = replica
+				stateNodes[best] = node
+
+				w := getPartitionWeight(partition.Name, topStateName, opts)
+				adjustStateNodeCounts(stateNodeCounts, topStateName,
+					[]string{node}, -w)
+				adjustStateNodeCounts(stateNodeCounts, topStateName,
+					[]string{replica}, w)
+				break
+			}
+		}
+
+		var warnings []string
+
+		// Move the node's remaining top priority partitions, which
+		// have no replicas, to other nodes.
+		partitionNamesToMove := map[string]bool{}
+		for _, partitionName := range partitionNames {
+			topNodes := downMap[partitionName].NodesByState[topStateName]
+			if len(StringsIntersectStrings(topNodes, []string{node})) > 0 {
+				partitionNamesToMove[partitionName] = true
+			}
+		}
+
+		if len(partitionNamesToMove) > 0 {
+			drainOpts := opts
+			if len(opts.NodeWarmUps) > 0 {
+				drainOpts.NodeCapacities = calcWarmUpCapacities(downMap,
+					nodesAll, model, opts)
+			}
+			drainOpts.NodeDrains = map[string]*NodeDrain{}
+			for n, drain := range opts.NodeDrains {
+				drainOpts.NodeDrains[n] = drain
+			}
+			drain := &NodeDrain{States: []string{topStateName}}
+			if prevDrain := opts.NodeDrains[node]; prevDrain != nil {
+				drain.States = append(drain.States, prevDrain.States...)
+				drain.MaxPartitions = prevDrain.MaxPartitions
+			}
+			drainOpts.NodeDrains[node] = drain
+
+			var planWarnings []PlanWarning
+
+			downMap, planWarnings, _ = planIncremental(downMap,
+				nodesAll, []string{},
+				PartitionModel{topStateName: model[topStateName]},
+				drainOpts, partitionNamesToMove)
+
+			warnings = planWarningStrings(planWarnings)
+		}
+
+		steps = append(steps, &RollingUpgradeStep{
+			Node:     node,
+			Down:     true,
+			Map:      downMap,
+			Moves:    calcPlanMoves(upMap, downMap, model, opts.FavorMinNodes),
+			Warnings: warnings,
+		})
+
+		steps = append(steps, &RollingUpgradeStep{
+			Node:  node,
+			Down:  false,
+			Map:   upMap,
+			Moves: calcPlanMoves(downMap, upMap, model, opts.FavorMinNodes),
+		})
+	}
+
+	return steps, nil
+}
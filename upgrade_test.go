@@ -0,0 +1,187 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanRollingUpgrade(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+
+	tests := []struct {
+		about     string
+		numSlaves int
+		expOps    map[string]bool // The ops allowed in the down steps.
+	}{
+		{
+			about:     "promote slaves",
+			numSlaves: 1,
+			expOps:    map[string]bool{"promote": true, "demote": true},
+		},
+		{
+			about:     "move masters without slaves",
+			numSlaves: 0,
+			expOps:    map[string]bool{"add": true, "del": true},
+		},
+	}
+
+	for i, test := range tests {
+		currMap := testPlanPrevMap(t, nodes, model, test.numSlaves)
+
+		steps, err := PlanRollingUpgrade(currMap, nodes,
+			[]string{"b", "a", "d", "c"}, model, PlanNextMapOptions{
+				ModelStateConstraints: map[string]int{
+					"slave": test.numSlaves,
+				},
+			})
+		if err != nil {
+			t.Errorf("i: %d, about: %s, expected no err, got: %v",
+				i, test.about, err)
+		}
+		if len(steps) != 8 {
+			t.Fatalf("i: %d, about: %s, expected 8 steps, got: %d",
+				i, test.about, len(steps))
+		}
+
+		for j, step := range steps {
+			if step.Down != (j%2 == 0) {
+				t.Errorf("i: %d, about: %s, j: %d, wrong Down: %v",
+					i, test.about, j, step.Down)
+			}
+			if len(step.Warnings) != 0 {
+				t.Errorf("i: %d, about: %s, j: %d, expected no warnings,"+
+					" got: %v", i, test.about, j, step.Warnings)
+			}
+			if len(step.Moves) <= 0 {
+				t.Errorf("i: %d, about: %s, j: %d, expected moves",
+					i, test.about, j)
+			}
+
+			for partitionName, partition := range step.Map {
+				masters := partition.NodesByState["master"]
+				if len(masters) != 1 ||
+					(step.Down && masters[0] == step.Node) {
+					t.Errorf("i: %d, about: %s, j: %d, partition: %s,"+
+						" bad masters: %v", i, test.about, j,
+						partitionName, partition.NodesByState)
+				}
+				if len(partition.NodesByState["slave"]) != test.numSlaves {
+					t.Errorf("i: %d, about: %s, j: %d, partition: %s,"+
+						" bad slaves: %v", i, test.about, j,
+						partitionName, partition.NodesByState)
+				}
+			}
+
+			if step.Down {
+				for partitionName, moves := range step.Moves {
+					for _, move := range moves {
+						if !test.expOps[move.Op] {
+							t.Errorf("i: %d, about: %s, j: %d,"+
+								" partition: %s, unexpected move: %v",
+								i, test.about, j, partitionName, move)
+						}
+					}
+				}
+			} else if !reflect.DeepEqual(step.Map, currMap) {
+				t.Errorf("i: %d, about: %s, j: %d, expected restored map,"+
+					" got: %v", i, test.about, j, step.Map)
+			}
+		}
+	}
+}
+
+func TestPlanRollingUpgradeUnderReplicated(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"slave": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b", "c", "d"}
+
+	// Half of the partitions are missing their slaves.
+	currMap := testPlanPrevMap(t, nodes, model, 1)
+	for _, partitionName := range []string{"00", "02", "04", "06"} {
+		delete(currMap[partitionName].NodesByState, "slave")
+	}
+
+	steps, err := PlanRollingUpgrade(currMap, nodes,
+		[]string{"a", "b", "c", "d"}, model, PlanNextMapOptions{})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if len(steps) != 8 {
+		t.Fatalf("expected 8 steps, got: %d", len(steps))
+	}
+
+	for j, step := range steps {
+		if !step.Down {
+			continue
+		}
+		for partitionName, partition := range step.Map {
+			if len(partition.NodesByState["slave"]) !=
+				len(currMap[partitionName].NodesByState["slave"]) {
+				t.Errorf("j: %d, partition: %s, expected no change to"+
+					" the slaves, got: %v", j, partitionName,
+					partition.NodesByState)
+			}
+		}
+		for partitionName := range step.Moves {
+			masters := currMap[partitionName].NodesByState["master"]
+			if len(StringsIntersectStrings(masters,
+				[]string{step.Node})) <= 0 {
+				t.Errorf("j: %d, node: %s, partition: %s, unexpected"+
+					" moves: %v", j, step.Node, partitionName,
+					step.Moves[partitionName])
+			}
+		}
+	}
+}
+
+func TestPlanRollingUpgradeErrors(t *testing.T) {
+	model := PartitionModel{
+		"master": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	nodes := []string{"a", "b"}
+
+	tests := []struct {
+		about      string
+		model      PartitionModel
+		nodesOrder []string
+	}{
+		{"empty model", PartitionModel{}, []string{"a"}},
+		{"unknown node", model, []string{"a", "x"}},
+		{"duplicate node", model, []string{"a", "b", "a"}},
+	}
+	for i, test := range tests {
+		steps, err := PlanRollingUpgrade(PartitionMap{}, nodes,
+			test.nodesOrder, test.model, PlanNextMapOptions{})
+		if err == nil || steps != nil {
+			t.Errorf("i: %d, about: %s, expected err, got: %v, %v",
+				i, test.about, steps, err)
+		}
+	}
+}